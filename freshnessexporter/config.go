@@ -3,6 +3,7 @@ package freshnessexporter
 import (
 	"errors"
 
+	weightupdateextension "github.com/alexandrosst/weightupdateextension"
 	"go.opentelemetry.io/collector/component"
 )
 
@@ -13,6 +14,16 @@ var Type = component.MustNewType(TypeStr)
 type Config struct {
 	SourceAttribute string            `mapstructure:"source_attribute"`
 	InitialSLOs     map[string]string `mapstructure:"initial_slos"` // e.g. "src1": "3s", "src2": "500ms"
+
+	// TenantKeys derives the tenant of a resource like the weightedqueue
+	// processor does; use the same rules in both. When empty, the tenant is
+	// the value of SourceAttribute.
+	TenantKeys []weightupdateextension.TenantKeyRule `mapstructure:"tenant_keys"`
+
+	// WeightDomain names the weightupdate extension whose SLO thresholds
+	// apply; use the same one as the weightedqueue processor. When unset,
+	// the only weightupdate extension is used.
+	WeightDomain *component.ID `mapstructure:"weight_domain"`
 }
 
 var _ component.Config = (*Config)(nil)
@@ -21,6 +32,9 @@ func (cfg *Config) Validate() error {
 	if cfg.SourceAttribute == "" {
 		cfg.SourceAttribute = "source.id"
 	}
+	if _, err := weightupdateextension.TenantKeyRulesOrAttribute(cfg.TenantKeys, cfg.SourceAttribute); err != nil {
+		return err
+	}
 
 	// Optional: basic sanity check for initial_slos
 	for tenant, durationStr := range cfg.InitialSLOs {
@@ -15,8 +15,10 @@ import (
 )
 
 type freshnessExporter struct {
-	cfg      *Config
-	settings exporter.Settings
+	cfg        *Config
+	settings   exporter.Settings
+	tenantKeys []weightupdateextension.TenantKeyRule
+	domain     *weightupdateextension.Domain // holds the SLO thresholds, see Config.WeightDomain
 
 	goodCounter  metric.Int64Counter
 	totalCounter metric.Int64Counter
@@ -47,6 +49,11 @@ func (e *freshnessExporter) start(ctx context.Context, host component.Host) erro
 
 	e.logger = e.settings.TelemetrySettings.Logger
 
+	e.domain, err = weightupdateextension.DomainFromHost(host, e.cfg.WeightDomain, e.logger)
+	if err != nil {
+		return err
+	}
+
 	// Apply any initial SLOs from config
 	for tenant, durationStr := range e.cfg.InitialSLOs {
 		duration, err := time.ParseDuration(durationStr)
@@ -57,7 +64,7 @@ func (e *freshnessExporter) start(ctx context.Context, host component.Host) erro
 				zap.Error(err))
 			continue
 		}
-		if err := weightupdateextension.SetSLOThresholdForTenant(tenant, duration.Nanoseconds(), "ns"); err != nil {
+		if err := e.domain.SeedSLOThresholdForTenant(tenant, duration.Nanoseconds(), "ns"); err != nil {
 			e.logger.Warn("Failed to apply initial SLO from config",
 				zap.String("source", tenant),
 				zap.String("duration", durationStr),
@@ -70,7 +77,7 @@ func (e *freshnessExporter) start(ctx context.Context, host component.Host) erro
 	}
 
 	e.logger.Info("Freshness exporter started",
-		zap.String("source_attribute", e.cfg.SourceAttribute))
+		zap.Any("tenant_keys", e.tenantKeys))
 
 	return nil
 }
@@ -83,11 +90,10 @@ func (e *freshnessExporter) consume(ctx context.Context, md pmetric.Metrics) err
 		rm := rms.At(i)
 		resAttrs := rm.Resource().Attributes()
 
-		sourceVal, sourceOk := resAttrs.Get(e.cfg.SourceAttribute)
-		if !sourceOk || sourceVal.Str() == "" {
+		source, sourceOk := weightupdateextension.ResolveTenant(resAttrs, e.tenantKeys)
+		if !sourceOk {
 			continue
 		}
-		source := sourceVal.Str()
 
 		var initialTs int64
 		found := false
@@ -118,7 +124,7 @@ func (e *freshnessExporter) consume(ctx context.Context, md pmetric.Metrics) err
 		freshnessNs := now - initialTs
 
 		// Per-tenant SLO from shared state (runtime-updatable)
-		threshold := weightupdateextension.GetSLOThresholdForTenant(source)
+		threshold := e.domain.GetSLOThresholdForTenant(source)
 
 		sourceAttr := attribute.String("source", source)
 
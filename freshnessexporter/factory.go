@@ -3,6 +3,8 @@ package freshnessexporter
 import (
 	"context"
 
+	weightupdateextension "github.com/alexandrosst/weightupdateextension"
+
 	"go.opentelemetry.io/collector/component"
 	"go.opentelemetry.io/collector/exporter"
 	"go.opentelemetry.io/collector/exporter/exporterhelper"
@@ -27,9 +29,15 @@ func createMetricsExporter(
 ) (exporter.Metrics, error) {
 	oCfg := cfg.(*Config)
 
+	tenantKeys, err := weightupdateextension.TenantKeyRulesOrAttribute(oCfg.TenantKeys, oCfg.SourceAttribute)
+	if err != nil {
+		return nil, err
+	}
+
 	exp := &freshnessExporter{
-		cfg:      oCfg,
-		settings: set, // exporter.Settings
+		cfg:        oCfg,
+		settings:   set, // exporter.Settings
+		tenantKeys: tenantKeys,
 	}
 
 	return exporterhelper.NewMetrics(
@@ -0,0 +1,51 @@
+package weightedqueueprocessor
+
+import (
+	"math"
+	"time"
+)
+
+// agingSteps quantizes the aging progress, so the effective weights, and
+// with them the schedulers' state, only change a few times per MaxWait
+const agingSteps = 10
+
+// agedWeights applies Config.Aging to the weights of the active tier. It
+// returns the effective weights and the source that waited longest beyond
+// MaxWait, or "" if none did. Sources with no weight do not age, and sources
+// that may not forward right now are never overdue.
+func (p *weightedQueueProcessor) agedWeights(weights map[string]float64) (map[string]float64, string) {
+	maxWait := p.config.Aging.MaxWait
+	if maxWait <= 0 {
+		return weights, ""
+	}
+
+	top := 0.0
+	for _, w := range weights {
+		top = math.Max(top, w)
+	}
+
+	now := time.Now()
+	aged := make(map[string]float64, len(weights))
+	overdue, oldest := "", time.Duration(0)
+	for source, w := range weights {
+		aged[source] = w
+		if w <= 0 {
+			continue
+		}
+		qIface, ok := p.queues.Load(source)
+		if !ok {
+			continue
+		}
+		since, ok := qIface.(*dynamicQueue).waitingSince()
+		if !ok {
+			continue
+		}
+		age := now.Sub(since)
+		if age >= maxWait && age > oldest && !p.view.held(source) {
+			overdue, oldest = source, age
+		}
+		progress := math.Floor(math.Min(float64(age)/float64(maxWait), 1)*agingSteps) / agingSteps
+		aged[source] = w + (top-w)*progress
+	}
+	return aged, overdue
+}
@@ -0,0 +1,82 @@
+package weightedqueueprocessor
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// maxCachedClasses bounds the classes cached by a classifier, so sources that
+// are only seen once, such as bogus source IDs, cannot grow it without limit
+const maxCachedClasses = 4096
+
+// classifier maps sources to scheduling classes. Rules are evaluated once
+// per source; the result is cached until the cache fills up, which starts it
+// over with the sources seen since.
+type classifier struct {
+	rules []compiledClassRule
+	mu    sync.RWMutex
+	cache map[string]string // source → class
+}
+
+type compiledClassRule struct {
+	re    *regexp.Regexp
+	class string
+}
+
+func newClassifier(rules []ClassRule) (*classifier, error) {
+	c := &classifier{cache: make(map[string]string)}
+	for i, rule := range rules {
+		re, err := rule.compile()
+		if err != nil {
+			return nil, fmt.Errorf("classes[%d]: %w", i, err)
+		}
+		c.rules = append(c.rules, compiledClassRule{re: re, class: rule.Class})
+	}
+	return c, nil
+}
+
+// compile turns the rule's glob or regex into an anchored regexp
+func (r ClassRule) compile() (*regexp.Regexp, error) {
+	if r.Class == "" {
+		return nil, fmt.Errorf("class is required")
+	}
+	if (r.Glob == "") == (r.Regex == "") {
+		return nil, fmt.Errorf("set either glob or regex")
+	}
+	if r.Glob != "" {
+		pattern := regexp.QuoteMeta(r.Glob)
+		pattern = strings.ReplaceAll(pattern, `\*`, ".*")
+		pattern = strings.ReplaceAll(pattern, `\?`, ".")
+		return regexp.Compile("^" + pattern + "$")
+	}
+	return regexp.Compile("^(?:" + r.Regex + ")$")
+}
+
+// classOf returns the class of source, or source itself if no rule matches
+func (c *classifier) classOf(source string) string {
+	if len(c.rules) == 0 {
+		return source
+	}
+	c.mu.RLock()
+	class, ok := c.cache[source]
+	c.mu.RUnlock()
+	if ok {
+		return class
+	}
+	class = source
+	for _, rule := range c.rules {
+		if rule.re.MatchString(source) {
+			class = rule.class
+			break
+		}
+	}
+	c.mu.Lock()
+	if len(c.cache) >= maxCachedClasses {
+		clear(c.cache)
+	}
+	c.cache[source] = class
+	c.mu.Unlock()
+	return class
+}
@@ -1,12 +1,449 @@
 package weightedqueueprocessor
 
-import "go.opentelemetry.io/collector/component"
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	weightupdateextension "github.com/alexandrosst/weightupdateextension"
+	"go.opentelemetry.io/collector/component"
+)
+
+// Supported values for Config.Scheduler.
+const (
+	SchedulerWeightedRandom = "weighted_random"
+	SchedulerRoundRobin     = "round_robin"
+	SchedulerDRR            = "drr"
+	SchedulerEDF            = "edf"
+)
+
+// Supported values for Config.CapacityPolicy.
+const (
+	CapacityEqual             = "equal"
+	CapacityWeighted          = "weighted"
+	CapacityWeightedWithFloor = "weighted_with_floor"
+)
+
+// Supported values for OverflowConfig.Policy and its per-source overrides.
+const (
+	OverflowDropNewest = "drop_newest"
+	OverflowDropOldest = "drop_oldest"
+	OverflowBlock      = "block"
+)
+
+// Supported values for OnboardingConfig.Policy.
+const (
+	OnboardingEqualRebalance     = "equal_rebalance"
+	OnboardingFixedDefaultWeight = "fixed_default_weight"
+	OnboardingTakeFromUnpinned   = "take_from_unpinned"
+)
+
+// Supported values for Config.TenantAdmission.
+const (
+	TenantAdmissionReject   = "reject"
+	TenantAdmissionOverflow = "overflow"
+)
+
+// Supported values for Config.CostUnit.
+const (
+	CostBatches    = "batches"
+	CostDataPoints = "datapoints"
+	CostBytes      = "bytes"
+	CostSpans      = "spans"
+	CostLogRecords = "log_records"
+	CostBodyBytes  = "body_bytes"
+)
 
 type Config struct {
 	SourceAttribute  string             `mapstructure:"source_attribute"`
 	InitialWeights   map[string]float64 `mapstructure:"initial_weights"`
 	PollIntervalMs   int                `mapstructure:"poll_interval_ms"`
 	MaxTotalCapacity int                `mapstructure:"max_total_capacity"`
+	MaxTotalBytes    int64              `mapstructure:"max_total_bytes"`    // 0 = unlimited
+	MaxQueueBytes    int64              `mapstructure:"max_queue_bytes"`    // per-source byte limit, 0 = unlimited
+	CapacityPolicy   string             `mapstructure:"capacity_policy"`    // equal (default) | weighted | weighted_with_floor
+	MinQueueCapacity int                `mapstructure:"min_queue_capacity"` // per-source floor for weighted_with_floor
+	Scheduler        string             `mapstructure:"scheduler"`          // weighted_random (default) | round_robin | drr | edf | registered name
+	Priorities       map[string]int     `mapstructure:"priorities"`         // source → tier, higher tiers drain first
+	CostUnit         string             `mapstructure:"cost_unit"`          // batches (default) | datapoints | spans | log_records | body_bytes | bytes
+
+	// MaxBatchesPerSecond caps the forwarding rate, counting every coalesced
+	// batch; 0 forwards as fast as the downstream consumer accepts batches.
+	MaxBatchesPerSecond float64 `mapstructure:"max_batches_per_second"`
+
+	// NumConsumers is the number of workers forwarding batches
+	// concurrently, so one slow downstream call does not stall every
+	// tenant. MaxInFlight caps the batches of one source forwarded at
+	// once, coalesced ones included (0 = unlimited); 1 keeps each source's
+	// batches in order.
+	NumConsumers      int            `mapstructure:"num_consumers"`
+	MaxInFlight       int            `mapstructure:"max_in_flight"`
+	SourceMaxInFlight map[string]int `mapstructure:"source_max_in_flight"` // per-source overrides of max_in_flight
+
+	// WeightDomain names the weightupdate extension whose weights, SLOs,
+	// priorities and rate limits this processor uses. Pipelines using
+	// different extensions are scheduled independently. When unset, the
+	// only weightupdate extension is used, or private state if there is
+	// none.
+	WeightDomain *component.ID `mapstructure:"weight_domain"`
+
+	// PinnedWeights are seeded like InitialWeights at start, but are never
+	// changed when sources join or leave. Pins can also be set at runtime
+	// through /update_weights.
+	PinnedWeights map[string]float64 `mapstructure:"pinned_weights"`
+
+	// Coalesce merges queued batches of the chosen source into one forward.
+	Coalesce CoalesceConfig `mapstructure:"coalesce"`
+
+	// Aging protects low-weight sources from starvation.
+	Aging AgingConfig `mapstructure:"aging"`
+
+	// TTL sheds queued batches that waited too long to be useful.
+	TTL TTLConfig `mapstructure:"ttl"`
+
+	// MetadataKeys lists the request metadata keys (client.Info.Metadata,
+	// such as receiver headers) kept with queued batches and restored when
+	// forwarding them. The client address and auth data are always kept.
+	MetadataKeys []string `mapstructure:"metadata_keys"`
+
+	// Onboarding decides the weight of a source seen for the first time.
+	Onboarding OnboardingConfig `mapstructure:"onboarding"`
+
+	// TenantKeys derives the source of a resource from its attributes: an
+	// ordered list of composite keys, fallback attributes and a constant
+	// default. When empty, the source is the value of SourceAttribute.
+	TenantKeys []weightupdateextension.TenantKeyRule `mapstructure:"tenant_keys"`
+
+	// SourceMaxQueueBytes overrides max_queue_bytes per source.
+	SourceMaxQueueBytes map[string]int64 `mapstructure:"source_max_queue_bytes"`
+
+	EDF EDFConfig `mapstructure:"edf"`
+
+	// RateLimits sets per-source token buckets (rate, burst, unit) that cap
+	// forwarding regardless of weights. Updatable via /update_rate_limits.
+	RateLimits map[string]weightupdateextension.RateLimit `mapstructure:"rate_limits"`
+
+	Overflow OverflowConfig `mapstructure:"overflow"`
+
+	Persistence PersistenceConfig `mapstructure:"persistence"`
+
+	Retry RetryConfig `mapstructure:"retry"`
+
+	UnassignedTenant UnassignedTenantConfig `mapstructure:"unassigned_tenant"`
+
+	// MaxTenants caps the number of sources holding a weight, so a flood of
+	// bogus source IDs cannot dilute the weights of real tenants. 0 is
+	// unlimited. TenantAdmission decides what happens to the data of a new
+	// source once the cap is reached: reject drops it, overflow sends it to
+	// the unassigned tenant.
+	MaxTenants      int    `mapstructure:"max_tenants"`
+	TenantAdmission string `mapstructure:"tenant_admission"` // reject (default) | overflow
+
+	// IdleTenantTimeout removes a source that sent no data for this long,
+	// together with its weight and SLO. 0 keeps sources forever.
+	IdleTenantTimeout time.Duration `mapstructure:"idle_tenant_timeout"`
+
+	// Classes groups sources into scheduling classes. The first matching
+	// rule decides; queues, weights, priorities and rate limits then apply
+	// per class while drops and forwarding are still reported per source.
+	Classes []ClassRule `mapstructure:"classes"`
+}
+
+// EDFConfig tunes the edf scheduler.
+type EDFConfig struct {
+	// DeprioritizeExpired serves batches that already missed their deadline
+	// only when no batch can still meet its SLO.
+	DeprioritizeExpired bool `mapstructure:"deprioritize_expired"`
+}
+
+// OverflowConfig decides what happens to a batch that does not fit in its
+// source queue or in max_total_capacity.
+type OverflowConfig struct {
+	Policy       string            `mapstructure:"policy"`        // drop_newest (default) | drop_oldest | block
+	BlockTimeout time.Duration     `mapstructure:"block_timeout"` // how long block waits for room
+	Sources      map[string]string `mapstructure:"sources"`       // per-source policy overrides
+}
+
+// CoalesceConfig merges consecutive queued batches of the source chosen by
+// the scheduler into one outgoing batch, cutting per-call overhead
+// downstream and keeping every outgoing batch to one source. The head batch
+// is always forwarded; further batches are merged while all limits hold.
+type CoalesceConfig struct {
+	MaxBatches    int   `mapstructure:"max_batches"`    // batches per forward, 0 or 1 disables coalescing
+	MaxDataPoints int   `mapstructure:"max_datapoints"` // data points, spans or log records per forward, 0 = unlimited
+	MaxBytes      int64 `mapstructure:"max_bytes"`      // OTLP bytes per forward, 0 = unlimited
+}
+
+// AgingConfig raises the effective weight of a source with the age of its
+// oldest queued batch, from its configured weight towards the largest
+// weight of its priority tier, which it reaches after MaxWait. The age
+// counts from the source's last forward if that is later, so only waiting
+// for service ages a source, not a backlog it is served from. A source that
+// waited MaxWait is served next, regardless of weights.
+type AgingConfig struct {
+	MaxWait time.Duration `mapstructure:"max_wait"` // 0 disables aging
+}
+
+// TTLConfig drops queued batches before they are dequeued once they are
+// past their time to live: queued longer than the max queue age of their
+// source, or, with UseSLO, past the freshness SLO deadline of their tenant.
+type TTLConfig struct {
+	MaxQueueAge time.Duration            `mapstructure:"max_queue_age"` // 0 = no limit
+	Sources     map[string]time.Duration `mapstructure:"sources"`       // per-source max_queue_age overrides
+	UseSLO      bool                     `mapstructure:"use_slo"`       // also expire batches past their SLO deadline
+}
+
+// OnboardingConfig decides how a new source gets its weight. Pinned weights
+// are never changed by any policy.
+//   - equal_rebalance: all unpinned sources, including the new one, share
+//     what the pinned weights leave equally
+//   - fixed_default_weight: the new source gets DefaultWeight and no other
+//     weight changes
+//   - take_from_unpinned: the new source gets DefaultWeight, taken from the
+//     unpinned sources in proportion to their weights
+type OnboardingConfig struct {
+	Policy        string  `mapstructure:"policy"`         // equal_rebalance (default) | fixed_default_weight | take_from_unpinned
+	DefaultWeight float64 `mapstructure:"default_weight"` // weight of a new source, in (0, 1)
+}
+
+// PersistenceConfig enables the on-disk write-ahead log of the queues.
+type PersistenceConfig struct {
+	// Directory holds one WAL file per source. Empty keeps queues in memory
+	// only, losing them on crash or shutdown.
+	Directory string `mapstructure:"directory"`
+	// Fsync syncs the WAL to disk before a batch is accepted, so a host
+	// crash loses no acknowledged batch, at the cost of one sync per batch.
+	Fsync bool `mapstructure:"fsync"`
+}
+
+// RetryConfig controls what happens to a batch the next consumer rejects
+// with a retryable error. Permanent errors are never retried.
+type RetryConfig struct {
+	// Enabled re-queues failed batches at the head of their source queue.
+	// When disabled, every failed batch is dropped.
+	Enabled         bool          `mapstructure:"enabled"`
+	InitialInterval time.Duration `mapstructure:"initial_interval"` // backoff after the first failure
+	MaxInterval     time.Duration `mapstructure:"max_interval"`     // upper bound of the backoff
+	Multiplier      float64       `mapstructure:"multiplier"`       // backoff growth per consecutive failure
+	// MaxAttempts drops a batch after this many failed forwards; 0 retries
+	// until the budget runs out.
+	MaxAttempts int `mapstructure:"max_attempts"`
+	// Budget caps the retries of each source per second, so a tenant whose
+	// data keeps failing cannot monopolize the forwarding path. 0 is
+	// unlimited.
+	Budget  float64            `mapstructure:"budget"`
+	Sources map[string]float64 `mapstructure:"sources"` // per-source budget overrides
+}
+
+// UnassignedTenantConfig routes resources that match no tenant key rule into
+// a dedicated catch-all queue instead of dropping them.
+type UnassignedTenantConfig struct {
+	Enabled bool   `mapstructure:"enabled"`
+	Name    string `mapstructure:"name"` // source name of the catch-all queue
+	// Weight is kept by the unassigned tenant when sources are added; the
+	// other sources share the rest equally. 0 treats it like any source.
+	Weight float64 `mapstructure:"weight"`
+	// Capacity reserves a fixed number of batches of max_total_capacity for
+	// the unassigned tenant. 0 applies the capacity policy.
+	Capacity int `mapstructure:"capacity"`
+}
+
+// ClassRule maps the sources matching Glob (* and ? wildcards) or Regex to
+// Class. Both patterns must match the whole source.
+type ClassRule struct {
+	Glob  string `mapstructure:"glob"`
+	Regex string `mapstructure:"regex"`
+	Class string `mapstructure:"class"`
 }
 
 var _ component.Config = (*Config)(nil)
+
+func (cfg *Config) Validate() error {
+	if _, err := weightupdateextension.TenantKeyRulesOrAttribute(cfg.TenantKeys, cfg.SourceAttribute); err != nil {
+		return err
+	}
+	if _, err := newClassifier(cfg.Classes); err != nil {
+		return err
+	}
+	if cfg.Scheduler == "" {
+		cfg.Scheduler = SchedulerWeightedRandom
+	}
+	if _, ok := lookupScheduler(cfg.Scheduler); !ok {
+		return fmt.Errorf("unknown scheduler %q: must be one of %v", cfg.Scheduler, registeredSchedulers())
+	}
+	switch cfg.CostUnit {
+	case "":
+		cfg.CostUnit = CostBatches
+	case CostBatches, CostDataPoints, CostSpans, CostLogRecords, CostBodyBytes, CostBytes:
+	default:
+		return fmt.Errorf("unknown cost_unit %q: must be %q, %q, %q, %q, %q or %q", cfg.CostUnit, CostBatches, CostDataPoints, CostSpans, CostLogRecords, CostBodyBytes, CostBytes)
+	}
+	switch cfg.CapacityPolicy {
+	case "":
+		cfg.CapacityPolicy = CapacityEqual
+	case CapacityEqual, CapacityWeighted, CapacityWeightedWithFloor:
+	default:
+		return fmt.Errorf("unknown capacity_policy %q: must be %q, %q or %q", cfg.CapacityPolicy, CapacityEqual, CapacityWeighted, CapacityWeightedWithFloor)
+	}
+	if cfg.MinQueueCapacity < 0 {
+		return errors.New("min_queue_capacity cannot be negative")
+	}
+	if cfg.MaxTotalBytes < 0 || cfg.MaxQueueBytes < 0 {
+		return errors.New("max_total_bytes and max_queue_bytes cannot be negative")
+	}
+	for source, limit := range cfg.SourceMaxQueueBytes {
+		if limit < 0 {
+			return fmt.Errorf("source_max_queue_bytes for source %q cannot be negative", source)
+		}
+	}
+	if cfg.PollIntervalMs <= 0 {
+		return errors.New("poll_interval_ms must be positive")
+	}
+	if cfg.NumConsumers <= 0 {
+		return errors.New("num_consumers must be positive")
+	}
+	if cfg.MaxInFlight < 0 {
+		return errors.New("max_in_flight cannot be negative")
+	}
+	for source, limit := range cfg.SourceMaxInFlight {
+		if limit < 0 {
+			return fmt.Errorf("source_max_in_flight for source %q cannot be negative", source)
+		}
+	}
+	if cfg.Coalesce.MaxBatches < 0 || cfg.Coalesce.MaxDataPoints < 0 || cfg.Coalesce.MaxBytes < 0 {
+		return errors.New("coalesce limits cannot be negative")
+	}
+	if cfg.Aging.MaxWait < 0 {
+		return errors.New("aging.max_wait cannot be negative")
+	}
+	if cfg.TTL.MaxQueueAge < 0 {
+		return errors.New("ttl.max_queue_age cannot be negative")
+	}
+	for source, age := range cfg.TTL.Sources {
+		if age < 0 {
+			return fmt.Errorf("ttl.sources: max queue age for %q cannot be negative", source)
+		}
+	}
+	seenKeys := make(map[string]bool)
+	for _, key := range cfg.MetadataKeys {
+		if key == "" {
+			return errors.New("metadata_keys cannot contain empty keys")
+		}
+		if seenKeys[strings.ToLower(key)] {
+			return fmt.Errorf("metadata_keys: duplicate key %q (keys are case-insensitive)", key)
+		}
+		seenKeys[strings.ToLower(key)] = true
+	}
+	if cfg.MaxBatchesPerSecond < 0 {
+		return errors.New("max_batches_per_second cannot be negative")
+	}
+	if cfg.Overflow.Policy == "" {
+		cfg.Overflow.Policy = OverflowDropNewest
+	}
+	if err := validateOverflowPolicy(cfg.Overflow.Policy); err != nil {
+		return err
+	}
+	for source, policy := range cfg.Overflow.Sources {
+		if err := validateOverflowPolicy(policy); err != nil {
+			return fmt.Errorf("overflow policy for source %q: %w", source, err)
+		}
+	}
+	if cfg.Overflow.BlockTimeout <= 0 {
+		return errors.New("overflow block_timeout must be positive")
+	}
+	if cfg.UnassignedTenant.Name == "" {
+		cfg.UnassignedTenant.Name = "unassigned"
+	}
+	if cfg.UnassignedTenant.Weight < 0 || cfg.UnassignedTenant.Weight >= 1 {
+		return errors.New("unassigned_tenant weight must be in [0, 1)")
+	}
+	if cfg.UnassignedTenant.Capacity < 0 || cfg.UnassignedTenant.Capacity >= cfg.MaxTotalCapacity {
+		return errors.New("unassigned_tenant capacity must be non-negative and below max_total_capacity")
+	}
+	if err := validateWeights("initial_weights", cfg.InitialWeights); err != nil {
+		return err
+	}
+	if err := validateWeights("pinned_weights", cfg.PinnedWeights); err != nil {
+		return err
+	}
+	var pinnedSum float64
+	if cfg.UnassignedTenant.Enabled {
+		pinnedSum = cfg.UnassignedTenant.Weight
+	}
+	for _, w := range cfg.PinnedWeights {
+		pinnedSum += w
+	}
+	if pinnedSum > 1 {
+		return errors.New("pinned_weights and the unassigned_tenant weight cannot sum to more than 1")
+	}
+	switch cfg.Onboarding.Policy {
+	case "":
+		cfg.Onboarding.Policy = OnboardingEqualRebalance
+	case OnboardingEqualRebalance:
+	case OnboardingFixedDefaultWeight, OnboardingTakeFromUnpinned:
+		if cfg.Onboarding.DefaultWeight <= 0 || cfg.Onboarding.DefaultWeight >= 1 {
+			return fmt.Errorf("onboarding default_weight must be in (0, 1) with policy %q", cfg.Onboarding.Policy)
+		}
+	default:
+		return fmt.Errorf("unknown onboarding policy %q: must be %q, %q or %q", cfg.Onboarding.Policy, OnboardingEqualRebalance, OnboardingFixedDefaultWeight, OnboardingTakeFromUnpinned)
+	}
+	if cfg.MaxTenants < 0 {
+		return errors.New("max_tenants cannot be negative")
+	}
+	switch cfg.TenantAdmission {
+	case "":
+		cfg.TenantAdmission = TenantAdmissionReject
+	case TenantAdmissionReject:
+	case TenantAdmissionOverflow:
+		if !cfg.UnassignedTenant.Enabled {
+			return errors.New("tenant_admission overflow requires unassigned_tenant to be enabled")
+		}
+	default:
+		return fmt.Errorf("unknown tenant_admission %q: must be %q or %q", cfg.TenantAdmission, TenantAdmissionReject, TenantAdmissionOverflow)
+	}
+	if cfg.IdleTenantTimeout < 0 {
+		return errors.New("idle_tenant_timeout cannot be negative")
+	}
+	if cfg.Retry.InitialInterval <= 0 || cfg.Retry.MaxInterval < cfg.Retry.InitialInterval {
+		return errors.New("retry initial_interval must be positive and not exceed max_interval")
+	}
+	if cfg.Retry.Multiplier < 1 {
+		return errors.New("retry multiplier must be at least 1")
+	}
+	if cfg.Retry.MaxAttempts < 0 {
+		return errors.New("retry max_attempts cannot be negative")
+	}
+	if cfg.Retry.Budget < 0 {
+		return errors.New("retry budget cannot be negative")
+	}
+	for source, budget := range cfg.Retry.Sources {
+		if budget < 0 {
+			return fmt.Errorf("retry budget for source %q cannot be negative", source)
+		}
+	}
+	for source, limit := range cfg.RateLimits {
+		if _, err := weightupdateextension.NormalizeRateLimit(limit); err != nil {
+			return fmt.Errorf("invalid rate_limits for source %q: %w", source, err)
+		}
+	}
+	return nil
+}
+
+func validateWeights(name string, weights map[string]float64) error {
+	for source, w := range weights {
+		if w < 0 {
+			return fmt.Errorf("%s for source %q cannot be negative", name, source)
+		}
+	}
+	return nil
+}
+
+func validateOverflowPolicy(policy string) error {
+	switch policy {
+	case OverflowDropNewest, OverflowDropOldest, OverflowBlock:
+		return nil
+	default:
+		return fmt.Errorf("unknown overflow policy %q: must be %q, %q or %q", policy, OverflowDropNewest, OverflowDropOldest, OverflowBlock)
+	}
+}
@@ -0,0 +1,173 @@
+package weightedqueueprocessor
+
+import (
+	"math"
+	"sort"
+)
+
+// drrEpsilon absorbs float rounding in quanta such as 0.6/0.1
+const drrEpsilon = 1e-9
+
+// drrScheduler implements Deficit Round Robin over the per-source queues.
+// Sources are visited in a fixed (sorted) order; on each visit a source earns
+// a quantum proportional to its weight and may forward batches while its
+// deficit covers their cost. The smallest positive weight earns one cost unit
+// per round, so the per-round deviation from the target share is bounded by
+// one quantum plus one batch.
+type drrScheduler struct {
+	queues  QueueView
+	weights map[string]float64
+	ring    []string
+	pos     int
+	visited bool // quantum already granted to ring[pos] on this visit
+	deficit map[string]float64
+}
+
+func newDRRScheduler(set SchedulerSettings) Scheduler {
+	return &drrScheduler{queues: set.Queues, deficit: make(map[string]float64)}
+}
+
+func (d *drrScheduler) OnEnqueue(string, BatchInfo) {}
+
+func (d *drrScheduler) OnWeightsChanged(weights map[string]float64) {
+	d.weights = weights
+	d.syncRing(weights)
+}
+
+// Next returns the source that should forward the next batch, or "" if no
+// source with a positive weight has queued data.
+func (d *drrScheduler) Next() string {
+	minWeight := 0.0
+	active := false
+	for _, src := range d.ring {
+		w := d.weights[src]
+		if w <= 0 {
+			continue
+		}
+		if minWeight == 0 || w < minWeight {
+			minWeight = w
+		}
+		if d.queues.Len(src) > 0 {
+			active = true
+		}
+	}
+	if !active {
+		return ""
+	}
+
+	// A pass over the ring grants every active source one quantum. When no
+	// head batch is affordable after a pass, the rounds that would forward
+	// nothing are skipped in one step, so the next pass always succeeds.
+	for attempt := 0; attempt < 2; attempt++ {
+		for i := 0; i < len(d.ring); i++ {
+			src := d.ring[d.pos]
+			w := d.weights[src]
+			head, ok := d.queues.Head(src)
+			if w <= 0 || !ok {
+				// A held source keeps its deficit for when it may forward
+				// again; an empty one loses it, but still owes its debt
+				if w <= 0 || !d.queues.Held(src) {
+					d.deficit[src] = math.Min(d.deficit[src], 0)
+				}
+				d.advance()
+				continue
+			}
+			if !d.visited {
+				d.deficit[src] += w / minWeight
+				d.visited = true
+			}
+			if d.deficit[src]+drrEpsilon >= head.Cost {
+				d.deficit[src] -= head.Cost
+				return src
+			}
+			d.advance()
+		}
+		d.skipIdleRounds(minWeight)
+	}
+	return ""
+}
+
+// Coalesce charges a further batch of source to its deficit, which may go
+// negative. The source then sits out the rounds that repay the debt, so the
+// cost shares stay exact while one round may deviate by a merged forward.
+func (d *drrScheduler) Coalesce(source string, batch BatchInfo) bool {
+	d.deficit[source] -= batch.Cost
+	return true
+}
+
+// skipIdleRounds adds the quanta of the rounds in which no source could
+// afford its head batch, leaving one round for the next pass to grant.
+func (d *drrScheduler) skipIdleRounds(minWeight float64) {
+	rounds := -1.0
+	for _, src := range d.ring {
+		w := d.weights[src]
+		head, ok := d.queues.Head(src)
+		if w <= 0 || !ok {
+			continue
+		}
+		quantum := w / minWeight
+		need := math.Ceil((head.Cost-d.deficit[src])/quantum) - 1
+		if rounds < 0 || need < rounds {
+			rounds = need
+		}
+	}
+	if rounds <= 0 {
+		return
+	}
+	for _, src := range d.ring {
+		w := d.weights[src]
+		if w <= 0 || d.queues.Len(src) == 0 {
+			continue
+		}
+		d.deficit[src] += rounds * w / minWeight
+	}
+}
+
+func (d *drrScheduler) advance() {
+	d.pos = (d.pos + 1) % len(d.ring)
+	d.visited = false
+}
+
+// syncRing rebuilds the visiting order when the set of weighted sources
+// changes, keeping the current position where possible.
+func (d *drrScheduler) syncRing(weights map[string]float64) {
+	if len(d.ring) == len(weights) {
+		same := true
+		for _, src := range d.ring {
+			if _, ok := weights[src]; !ok {
+				same = false
+				break
+			}
+		}
+		if same {
+			return
+		}
+	}
+
+	current := ""
+	if d.pos < len(d.ring) {
+		current = d.ring[d.pos]
+	}
+
+	ring := make([]string, 0, len(weights))
+	for src := range weights {
+		ring = append(ring, src)
+	}
+	sort.Strings(ring)
+
+	for src := range d.deficit {
+		if _, ok := weights[src]; !ok {
+			delete(d.deficit, src)
+		}
+	}
+
+	d.ring = ring
+	d.pos = 0
+	d.visited = false
+	for i, src := range ring {
+		if src == current {
+			d.pos = i
+			break
+		}
+	}
+}
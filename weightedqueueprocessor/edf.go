@@ -0,0 +1,57 @@
+package weightedqueueprocessor
+
+import "time"
+
+// edfScheduler implements Earliest Deadline First over the head batches of
+// the per-source queues. A batch's deadline is its initial_timestamp plus its
+// tenant's freshness SLO threshold, so the batch closest to missing its SLO
+// is always forwarded first. Weights only decide eligibility: sources with a
+// non-positive weight are never served.
+type edfScheduler struct {
+	queues              QueueView
+	weights             map[string]float64
+	deprioritizeExpired bool
+}
+
+func newEDFScheduler(set SchedulerSettings) Scheduler {
+	return &edfScheduler{
+		queues:              set.Queues,
+		deprioritizeExpired: set.Config.EDF.DeprioritizeExpired,
+	}
+}
+
+func (s *edfScheduler) OnEnqueue(string, BatchInfo) {}
+
+func (s *edfScheduler) OnWeightsChanged(weights map[string]float64) {
+	s.weights = weights
+}
+
+func (s *edfScheduler) Next() string {
+	now := time.Now()
+
+	var best, bestExpired string
+	var bestDeadline, bestExpiredDeadline time.Time
+	for source, w := range s.weights {
+		if w <= 0 {
+			continue
+		}
+		head, ok := s.queues.Head(source)
+		if !ok {
+			continue
+		}
+		if s.deprioritizeExpired && head.Deadline.Before(now) {
+			if bestExpired == "" || head.Deadline.Before(bestExpiredDeadline) {
+				bestExpired, bestExpiredDeadline = source, head.Deadline
+			}
+			continue
+		}
+		if best == "" || head.Deadline.Before(bestDeadline) {
+			best, bestDeadline = source, head.Deadline
+		}
+	}
+
+	if best != "" {
+		return best
+	}
+	return bestExpired
+}
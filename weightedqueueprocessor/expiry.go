@@ -0,0 +1,53 @@
+package weightedqueueprocessor
+
+import (
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// ttlEnabled reports whether Config.TTL expires any batches
+func (p *weightedQueueProcessor) ttlEnabled() bool {
+	ttl := p.config.TTL
+	return ttl.MaxQueueAge > 0 || len(ttl.Sources) > 0 || ttl.UseSLO
+}
+
+// maxQueueAge returns how long batches may wait in the queue of source, 0
+// if unlimited
+func (p *weightedQueueProcessor) maxQueueAge(source string) time.Duration {
+	if age, ok := p.config.TTL.Sources[source]; ok {
+		return age
+	}
+	return p.config.TTL.MaxQueueAge
+}
+
+// isExpired reports whether item, queued for source, is past its TTL at now.
+// The SLO deadline is the one schedulers see, so runtime SLO updates apply.
+func (p *weightedQueueProcessor) isExpired(source string, item queueItem, now time.Time) bool {
+	if age := p.maxQueueAge(source); age > 0 && now.Sub(item.enqueuedAt) >= age {
+		return true
+	}
+	return p.config.TTL.UseSLO && now.After(batchInfo(p.domain, item).Deadline)
+}
+
+// shedExpired drops expired batches from every queue. Before each
+// scheduling decision only the expired batches at the head are dropped, so
+// no expired batch is forwarded; the periodic sweep also frees the capacity
+// taken by expired batches further back.
+func (p *weightedQueueProcessor) shedExpired(headOnly bool) {
+	if !p.ttlEnabled() {
+		return
+	}
+	now := time.Now()
+	p.queues.Range(func(key, value any) bool {
+		source := key.(string)
+		expired := value.(*dynamicQueue).shed(func(item queueItem) bool {
+			return p.isExpired(source, item, now)
+		}, headOnly)
+		if len(expired) > 0 {
+			p.logger.Debug("Dropping expired batches", zap.String("source", source), zap.Int("batches", len(expired)))
+			p.discard(dropReasonExpired, expired...)
+		}
+		return true
+	})
+}
@@ -3,11 +3,13 @@ package weightedqueueprocessor
 import (
 	"context"
 	"fmt"
+	"slices"
+	"time"
 
+	weightupdateextension "github.com/alexandrosst/weightupdateextension"
 	"go.opentelemetry.io/collector/component"
 	"go.opentelemetry.io/collector/consumer"
 	"go.opentelemetry.io/collector/processor"
-	"go.opentelemetry.io/otel/attribute"
 	"go.opentelemetry.io/otel/metric"
 )
 
@@ -23,6 +25,8 @@ func NewFactory() processor.Factory {
 		processorType,
 		createDefaultConfig,
 		processor.WithMetrics(createMetricsProcessor, stability),
+		processor.WithTraces(createTracesProcessor, stability),
+		processor.WithLogs(createLogsProcessor, stability),
 	)
 }
 
@@ -31,7 +35,31 @@ func createDefaultConfig() component.Config {
 		SourceAttribute:  "source.id",
 		InitialWeights:   make(map[string]float64),
 		PollIntervalMs:   100,
+		NumConsumers:     1,
 		MaxTotalCapacity: 1000, // New
+		CapacityPolicy:   CapacityEqual,
+		MinQueueCapacity: 1,
+		Scheduler:        SchedulerWeightedRandom,
+		Priorities:       make(map[string]int),
+		CostUnit:         CostBatches,
+		Overflow: OverflowConfig{
+			Policy:       OverflowDropNewest,
+			BlockTimeout: time.Second,
+		},
+		Retry: RetryConfig{
+			Enabled:         true,
+			InitialInterval: 100 * time.Millisecond,
+			MaxInterval:     5 * time.Second,
+			Multiplier:      2,
+			Budget:          10,
+		},
+		UnassignedTenant: UnassignedTenantConfig{
+			Name: "unassigned",
+		},
+		TenantAdmission: TenantAdmissionReject,
+		Onboarding: OnboardingConfig{
+			Policy: OnboardingEqualRebalance,
+		},
 	}
 }
 
@@ -41,13 +69,76 @@ func createMetricsProcessor(
 	cfg component.Config,
 	nextConsumer consumer.Metrics,
 ) (processor.Metrics, error) {
-	conf := cfg.(*Config)
+	return newWeightedQueueProcessor(set, cfg.(*Config), metricsSignal, func(ctx context.Context, data telemetry) error {
+		return nextConsumer.ConsumeMetrics(ctx, data.(metricsBatch).md)
+	})
+}
+
+func createTracesProcessor(
+	ctx context.Context,
+	set processor.Settings,
+	cfg component.Config,
+	nextConsumer consumer.Traces,
+) (processor.Traces, error) {
+	return newWeightedQueueProcessor(set, cfg.(*Config), tracesSignal, func(ctx context.Context, data telemetry) error {
+		return nextConsumer.ConsumeTraces(ctx, data.(tracesBatch).td)
+	})
+}
+
+func createLogsProcessor(
+	ctx context.Context,
+	set processor.Settings,
+	cfg component.Config,
+	nextConsumer consumer.Logs,
+) (processor.Logs, error) {
+	return newWeightedQueueProcessor(set, cfg.(*Config), logsSignal, func(ctx context.Context, data telemetry) error {
+		return nextConsumer.ConsumeLogs(ctx, data.(logsBatch).ld)
+	})
+}
+
+// newWeightedQueueProcessor builds the processor of one signal. Processors
+// of different signals keep their own queues and share the tenant weights
+// through their weight domain, see weightupdateextension.DomainFromHost.
+func newWeightedQueueProcessor(
+	set processor.Settings,
+	conf *Config,
+	signal signalKind,
+	consume func(context.Context, telemetry) error,
+) (*weightedQueueProcessor, error) {
+	if !slices.Contains(signal.costUnits, conf.CostUnit) {
+		return nil, fmt.Errorf("cost_unit %q does not apply to %s: must be one of %v", conf.CostUnit, signal.name, signal.costUnits)
+	}
+
+	tenantKeys, err := weightupdateextension.TenantKeyRulesOrAttribute(conf.TenantKeys, conf.SourceAttribute)
+	if err != nil {
+		return nil, err
+	}
+
+	classes, err := newClassifier(conf.Classes)
+	if err != nil {
+		return nil, err
+	}
+
+	newScheduler, ok := lookupScheduler(conf.Scheduler)
+	if !ok {
+		return nil, fmt.Errorf("unknown scheduler %q", conf.Scheduler)
+	}
 
 	p := &weightedQueueProcessor{
-		config:       conf,
-		nextConsumer: nextConsumer,
-		logger:       set.Logger,
-		shutdownCh:   make(chan struct{}),
+		config:         conf,
+		signal:         signal,
+		tenantKeys:     tenantKeys,
+		classes:        classes,
+		consume:        consume,
+		logger:         set.Logger,
+		shutdownCh:     make(chan struct{}),
+		notifyCh:       make(chan struct{}, 1),
+		newScheduler:   newScheduler,
+		tierSchedulers: make(map[int]Scheduler),
+		tierWeights:    make(map[int]map[string]float64),
+		limiter:        newRateLimiter(),
+		retry:          newRetryTracker(conf.Retry),
+		inFlight:       newInFlightLimiter(conf.MaxInFlight, conf.SourceMaxInFlight),
 	}
 
 	// Create initial gauges/counters (for metrics exposure)
@@ -55,7 +146,7 @@ func createMetricsProcessor(
 
 	forwardedBatches, err := meter.Int64Counter(
 		"weightedqueue_forwarded_batches_total",
-		metric.WithDescription("Total number of metric batches successfully forwarded from each source queue"),
+		metric.WithDescription("Total number of batches successfully forwarded from each source queue"),
 		metric.WithUnit("1"),
 	)
 	if err != nil {
@@ -63,9 +154,39 @@ func createMetricsProcessor(
 	}
 	p.forwardedBatchesCounter = forwardedBatches
 
+	forwardedCost, err := meter.Int64Counter(
+		"weightedqueue_forwarded_cost_total",
+		metric.WithDescription("Total cost forwarded from each source queue, measured in the configured cost unit"),
+		metric.WithUnit(costMetricUnit(conf.CostUnit)),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create forwarded cost counter: %w", err)
+	}
+	p.forwardedCostCounter = forwardedCost
+
+	retried, err := meter.Int64Counter(
+		"weightedqueue_retried_batches_total",
+		metric.WithDescription("Total batches re-queued after a retryable downstream failure, per source"),
+		metric.WithUnit("1"),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create retried batches counter: %w", err)
+	}
+	p.retriedBatchesCounter = retried
+
+	throttled, err := meter.Float64Counter(
+		"weightedqueue_throttled_seconds_total",
+		metric.WithDescription("Total time each source had queued data but was held back by its rate limit"),
+		metric.WithUnit("s"),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create throttled time counter: %w", err)
+	}
+	p.throttledCounter = throttled
+
 	droppedBatches, err := meter.Int64Counter(
 		"weightedqueue_dropped_batches_total",
-		metric.WithDescription("Total dropped batches due to capacity"),
+		metric.WithDescription("Total dropped or evicted batches per source, by reason"),
 		metric.WithUnit("1"),
 	)
 	if err != nil {
@@ -73,6 +194,36 @@ func createMetricsProcessor(
 	}
 	p.droppedBatchesCounter = droppedBatches
 
+	unattributed, err := meter.Int64Counter(
+		"weightedqueue_unattributed_batches_total",
+		metric.WithDescription("Total resource batches that matched no tenant key rule"),
+		metric.WithUnit("1"),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create unattributed batches counter: %w", err)
+	}
+	p.unattributedCounter = unattributed
+
+	tenantLimited, err := meter.Int64Counter(
+		"weightedqueue_tenant_limited_batches_total",
+		metric.WithDescription("Total resource batches of new sources beyond max_tenants"),
+		metric.WithUnit("1"),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create tenant limited batches counter: %w", err)
+	}
+	p.tenantLimitedCounter = tenantLimited
+
+	aged, err := meter.Int64Counter(
+		"weightedqueue_aged_batches_total",
+		metric.WithDescription("Total batches served ahead of the scheduler because they waited aging.max_wait"),
+		metric.WithUnit("1"),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create aged batches counter: %w", err)
+	}
+	p.agedBatchesCounter = aged
+
 	queueLength, err := meter.Int64ObservableGauge(
 		"weightedqueue_queue_length",
 		metric.WithDescription("Current queue length per source"),
@@ -83,24 +234,65 @@ func createMetricsProcessor(
 	}
 	p.queueLengthGauge = queueLength
 
+	queueBytes, err := meter.Int64ObservableGauge(
+		"weightedqueue_queue_bytes",
+		metric.WithDescription("Current queued bytes per source, measured as OTLP proto size"),
+		metric.WithUnit("By"),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create queue bytes gauge: %w", err)
+	}
+	p.queueBytesGauge = queueBytes
+
+	effectiveWeight, err := meter.Float64ObservableGauge(
+		"weightedqueue_effective_weight",
+		metric.WithDescription("Weight each source is currently scheduled with, after aging"),
+		metric.WithUnit("1"),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create effective weight gauge: %w", err)
+	}
+	p.effectiveWeightGauge = effectiveWeight
+
 	// Register observable callback
 	_, err = meter.RegisterCallback(
 		func(_ context.Context, o metric.Observer) error {
 			p.queues.Range(func(key, value any) bool {
 				source := key.(string)
 				q := value.(*dynamicQueue)
-				o.ObserveInt64(queueLength, int64(q.len()),
-					metric.WithAttributes(attribute.String("source", source)),
-				)
+				o.ObserveInt64(queueLength, int64(q.len()), p.attrs(source))
+				o.ObserveInt64(queueBytes, q.size(), p.attrs(source))
 				return true
 			})
+			p.schedMu.Lock()
+			for source, w := range p.effectiveWeights {
+				o.ObserveFloat64(effectiveWeight, w, p.attrs(source))
+			}
+			p.schedMu.Unlock()
 			return nil
 		},
 		queueLength,
+		queueBytes,
+		effectiveWeight,
 	)
 	if err != nil {
-		return nil, fmt.Errorf("failed to register queue length callback: %w", err)
+		return nil, fmt.Errorf("failed to register queue gauges callback: %w", err)
 	}
 
 	return p, nil
 }
+
+func costMetricUnit(costUnit string) string {
+	switch costUnit {
+	case CostDataPoints:
+		return "{datapoints}"
+	case CostSpans:
+		return "{spans}"
+	case CostLogRecords:
+		return "{log_records}"
+	case CostBytes, CostBodyBytes:
+		return "By"
+	default:
+		return "{batches}"
+	}
+}
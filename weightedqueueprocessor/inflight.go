@@ -0,0 +1,55 @@
+package weightedqueueprocessor
+
+import "sync"
+
+// inFlightLimiter caps how many batches of each source the consumers
+// forward at once, so a tenant whose batches are slow downstream cannot
+// occupy every consumer. The queue view hides sources at their limit.
+type inFlightLimiter struct {
+	mu      sync.Mutex
+	limit   int            // per-source limit, 0 = unlimited
+	sources map[string]int // per-source overrides
+	counts  map[string]int // batches being forwarded per source
+}
+
+func newInFlightLimiter(limit int, sources map[string]int) *inFlightLimiter {
+	return &inFlightLimiter{limit: limit, sources: sources, counts: make(map[string]int)}
+}
+
+func (l *inFlightLimiter) limitFor(source string) int {
+	if limit, ok := l.sources[source]; ok {
+		return limit
+	}
+	return l.limit
+}
+
+// isFull reports whether source may not start another forward
+func (l *inFlightLimiter) isFull(source string) bool {
+	limit := l.limitFor(source)
+	if limit <= 0 {
+		return false
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.counts[source] >= limit
+}
+
+// acquire counts n batches of source as being forwarded
+func (l *inFlightLimiter) acquire(source string, n int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.counts[source] += n
+}
+
+// release ends the forward of n batches of source and reports whether the
+// source was at its limit, i.e. whether a waiting consumer may now pick it
+func (l *inFlightLimiter) release(source string, n int) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	limit := l.limitFor(source)
+	full := limit > 0 && l.counts[source] >= limit
+	if l.counts[source] -= n; l.counts[source] <= 0 {
+		delete(l.counts, source)
+	}
+	return full
+}
@@ -0,0 +1,137 @@
+package weightedqueueprocessor
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"reflect"
+	"slices"
+	"sort"
+
+	"go.opentelemetry.io/collector/client"
+)
+
+// clientInfo returns the client.Info of the request in ctx to queue with its
+// batches: the client address and auth data, and the request metadata under
+// Config.MetadataKeys only.
+func (p *weightedQueueProcessor) clientInfo(ctx context.Context) client.Info {
+	info := client.FromContext(ctx)
+	kept := make(map[string][]string)
+	for _, key := range p.config.MetadataKeys {
+		if values := info.Metadata.Get(key); len(values) > 0 {
+			kept[key] = values
+		}
+	}
+	info.Metadata = client.NewMetadata(kept)
+	return info
+}
+
+// sameClient reports whether two batches come from the same client, with
+// the same auth data and the same values for every key of
+// Config.MetadataKeys, so they may be forwarded in one request without
+// attributing one client's data to another
+func (p *weightedQueueProcessor) sameClient(a, b client.Info) bool {
+	if !sameAuth(a.Auth, b.Auth) || !sameAddr(a.Addr, b.Addr) {
+		return false
+	}
+	for _, key := range p.config.MetadataKeys {
+		if !slices.Equal(a.Metadata.Get(key), b.Metadata.Get(key)) {
+			return false
+		}
+	}
+	return true
+}
+
+// sameAuth compares auth data by identity. Auth data of a type that cannot
+// be compared is only the same if both are nil.
+func sameAuth(a, b client.AuthData) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	ta, tb := reflect.TypeOf(a), reflect.TypeOf(b)
+	return ta == tb && ta.Comparable() && a == b
+}
+
+func sameAddr(a, b net.Addr) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	return a.Network() == b.Network() && a.String() == b.String()
+}
+
+// appendMetadata encodes md for the WAL:
+//
+//	keys(4) { keyLen(4) key values(4) { valueLen(4) value } }
+func appendMetadata(buf []byte, md client.Metadata) []byte {
+	var keys []string
+	for key := range md.Keys() {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(len(keys)))
+	for _, key := range keys {
+		values := md.Get(key)
+		buf = binary.LittleEndian.AppendUint32(buf, uint32(len(key)))
+		buf = append(buf, key...)
+		buf = binary.LittleEndian.AppendUint32(buf, uint32(len(values)))
+		for _, value := range values {
+			buf = binary.LittleEndian.AppendUint32(buf, uint32(len(value)))
+			buf = append(buf, value...)
+		}
+	}
+	return buf
+}
+
+var errShortMetadata = errors.New("truncated metadata")
+
+// parseMetadata decodes metadata encoded by appendMetadata
+func parseMetadata(buf []byte) (client.Metadata, error) {
+	next := func(n int) ([]byte, error) {
+		if len(buf) < n {
+			return nil, errShortMetadata
+		}
+		b := buf[:n]
+		buf = buf[n:]
+		return b, nil
+	}
+
+	b, err := next(4)
+	if err != nil {
+		return client.Metadata{}, err
+	}
+	keys := binary.LittleEndian.Uint32(b)
+	md := make(map[string][]string)
+	for range keys {
+		if b, err = next(4); err != nil {
+			return client.Metadata{}, err
+		}
+		key, err := next(int(binary.LittleEndian.Uint32(b)))
+		if err != nil {
+			return client.Metadata{}, err
+		}
+		if b, err = next(4); err != nil {
+			return client.Metadata{}, err
+		}
+		n := int(binary.LittleEndian.Uint32(b))
+		if n > len(buf)/4 {
+			return client.Metadata{}, errShortMetadata
+		}
+		values := make([]string, n)
+		for i := range values {
+			if b, err = next(4); err != nil {
+				return client.Metadata{}, err
+			}
+			value, err := next(int(binary.LittleEndian.Uint32(b)))
+			if err != nil {
+				return client.Metadata{}, err
+			}
+			values[i] = string(value)
+		}
+		md[string(key)] = values
+	}
+	if len(buf) > 0 {
+		return client.Metadata{}, errors.New("trailing bytes after metadata")
+	}
+	return client.NewMetadata(md), nil
+}
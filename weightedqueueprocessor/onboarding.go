@@ -0,0 +1,88 @@
+package weightedqueueprocessor
+
+import (
+	weightupdateextension "github.com/alexandrosst/weightupdateextension"
+	"go.uber.org/zap"
+)
+
+// seedWeights applies initial_weights and pinned_weights at start. Sources
+// that already have a weight, e.g. set through the API or by another
+// pipeline, keep it; pins always apply. The unassigned tenant's configured
+// weight is pinned for when it first receives data.
+func (p *weightedQueueProcessor) seedWeights() {
+	shared := p.domain.Weights
+	shared.Lock()
+	seeded := 0
+	for source, w := range p.config.InitialWeights {
+		if _, ok := shared.Weights[source]; !ok {
+			shared.Weights[source] = w
+			seeded++
+		}
+	}
+	for source, w := range p.config.PinnedWeights {
+		shared.Pinned[source] = w
+		if current, ok := shared.Weights[source]; !ok || current != w {
+			shared.Weights[source] = w
+			seeded++
+		}
+	}
+	if u := p.config.UnassignedTenant; u.Enabled && u.Weight > 0 {
+		shared.Pinned[u.Name] = u.Weight
+	}
+	shared.NumSources = len(shared.Weights)
+	shared.Unlock()
+
+	if seeded > 0 {
+		shared.NotifyChanged()
+		p.logger.Info("Seeded weights from config", zap.Int("sources", seeded))
+	}
+}
+
+// onboard gives a source that joins the shared weights its weight under the
+// onboarding policy. A pinned source gets its pinned weight, which
+// take_from_unpinned funds like a default weight. Callers hold the
+// lock of shared.
+func (p *weightedQueueProcessor) onboard(shared *weightupdateextension.SharedWeights, source string) {
+	w, pinned := shared.Pinned[source]
+	if !pinned {
+		w = p.config.Onboarding.DefaultWeight
+	}
+
+	switch p.config.Onboarding.Policy {
+	case OnboardingFixedDefaultWeight:
+		shared.Weights[source] = w
+	case OnboardingTakeFromUnpinned:
+		// Without enough unpinned weight to take from, e.g. for the first
+		// source, fall back to sharing equally
+		unpinned := shared.UnpinnedSum()
+		if unpinned <= w {
+			shared.Weights[source] = 0
+			shared.RebalanceEqually()
+			return
+		}
+		shared.ScaleUnpinned((unpinned - w) / unpinned)
+		shared.Weights[source] = w
+	default:
+		shared.Weights[source] = 0
+		shared.RebalanceEqually()
+	}
+}
+
+// offboard removes source from the shared weights. Under take_from_unpinned
+// its weight goes back to the unpinned sources in proportion to their
+// weights; fixed_default_weight leaves the other weights alone. Callers hold
+// the lock of shared.
+func (p *weightedQueueProcessor) offboard(shared *weightupdateextension.SharedWeights, source string) {
+	w := shared.Weights[source]
+	delete(shared.Weights, source)
+
+	switch p.config.Onboarding.Policy {
+	case OnboardingFixedDefaultWeight:
+	case OnboardingTakeFromUnpinned:
+		if unpinned := shared.UnpinnedSum(); unpinned > 0 {
+			shared.ScaleUnpinned((unpinned + w) / unpinned)
+		}
+	default:
+		shared.RebalanceEqually()
+	}
+}
@@ -0,0 +1,216 @@
+package weightedqueueprocessor
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.uber.org/zap"
+)
+
+// Values of the reason attribute on weightedqueue_dropped_batches_total.
+const (
+	dropReasonQueueFull      = "queue_full"      // per-source queue full (batches or bytes)
+	dropReasonGlobalFull     = "global_full"     // max_total_capacity or max_total_bytes reached
+	dropReasonEvictedOldest  = "evicted_oldest"  // drop_oldest: head batch made room for a new one
+	dropReasonBlockTimeout   = "block_timeout"   // block: no room within block_timeout
+	dropReasonCapacityShrink = "capacity_shrink" // queued batches beyond a reduced capacity
+	dropReasonSourceDeleted  = "source_deleted"  // queue of a deleted source discarded
+	dropReasonShutdown       = "shutdown"        // queued batches discarded on shutdown
+	dropReasonPermanentError = "permanent_error" // next consumer rejected the batch permanently
+	dropReasonRetryDisabled  = "retry_disabled"  // forward failed and retry is disabled
+	dropReasonMaxAttempts    = "max_attempts"    // forward failed retry.max_attempts times
+	dropReasonRetryBudget    = "retry_budget"    // forward failed with the source's retry budget spent
+	dropReasonExpired        = "expired"         // queued longer than the source's TTL
+)
+
+var errGlobalFull = errors.New("global queue full: backpressure")
+
+var errShuttingDown = errors.New("processor is shutting down")
+
+// errQueueClosed is returned when the queue was closed, because its source
+// was removed, before the batch got in. The caller retries on the queue the
+// source has now.
+var errQueueClosed = errors.New("queue closed")
+
+// overflowPolicy returns the policy for source: its override or the default
+func (p *weightedQueueProcessor) overflowPolicy(source string) string {
+	if policy, ok := p.config.Overflow.Sources[source]; ok {
+		return policy
+	}
+	return p.config.Overflow.Policy
+}
+
+// enqueue queues item for source, applying the source's overflow policy
+// when the queue or the global capacity is full. It reports whether item was
+// queued; an error asks the caller to apply backpressure upstream.
+func (p *weightedQueueProcessor) enqueue(ctx context.Context, source string, queue *dynamicQueue, item queueItem) (bool, error) {
+	switch p.overflowPolicy(source) {
+	case OverflowDropOldest:
+		return p.enqueueDropOldest(source, queue, item)
+	case OverflowBlock:
+		return p.enqueueBlocking(ctx, source, queue, item)
+	default:
+		return p.enqueueDropNewest(source, queue, item)
+	}
+}
+
+// globalExcess returns how many batches and bytes must leave the queues
+// before item fits within max_total_capacity and max_total_bytes
+func (p *weightedQueueProcessor) globalExcess(item queueItem) (int, int64) {
+	batches := 0
+	if p.totalEnqueued.Load()+1 > int64(p.config.MaxTotalCapacity) {
+		batches = 1
+	}
+	var bytes int64
+	if p.config.MaxTotalBytes > 0 {
+		bytes = max(p.totalBytes.Load()+item.bytes-p.config.MaxTotalBytes, 0)
+	}
+	return batches, bytes
+}
+
+// admit accounts for a queued item in the global totals and in the pending
+// batches of its source in the domain, see expireIdleTenants
+func (p *weightedQueueProcessor) admit(item queueItem) {
+	p.totalEnqueued.Add(1)
+	p.totalBytes.Add(item.bytes)
+	p.domain.AddPending(item.source, 1)
+}
+
+func (p *weightedQueueProcessor) enqueueDropNewest(source string, queue *dynamicQueue, item queueItem) (bool, error) {
+	if batches, bytes := p.globalExcess(item); batches > 0 || bytes > 0 {
+		p.logger.Warn("Global capacity exceeded, dropping batch", zap.String("source", source))
+		p.recordDrops(item.origin, dropReasonGlobalFull, 1)
+		return false, errGlobalFull
+	}
+	if !queue.enqueue(item) {
+		if queue.isClosed() {
+			return false, errQueueClosed
+		}
+		p.logger.Warn("Per-queue capacity exceeded, dropping batch", zap.String("source", source))
+		p.recordDrops(item.origin, dropReasonQueueFull, 1)
+		return false, nil
+	}
+	p.admit(item)
+	return true, nil
+}
+
+// enqueueDropOldest makes room by evicting the source's own oldest batches,
+// so one tenant's overload never evicts another tenant's data.
+func (p *weightedQueueProcessor) enqueueDropOldest(source string, queue *dynamicQueue, item queueItem) (bool, error) {
+	batches, bytes := p.globalExcess(item)
+	evicted, ok := queue.enqueueEvicting(item, batches, bytes)
+	p.discard(dropReasonEvictedOldest, evicted...)
+	if !ok {
+		if queue.isClosed() {
+			return false, errQueueClosed
+		}
+		if batches == 0 && bytes == 0 {
+			// The batch alone exceeds the queue's byte limit
+			p.logger.Warn("Per-queue capacity exceeded, dropping batch", zap.String("source", source))
+			p.recordDrops(item.origin, dropReasonQueueFull, 1)
+			return false, nil
+		}
+		// Global capacity is held by other sources and this queue cannot
+		// free enough of it
+		p.logger.Warn("Global capacity exceeded, dropping batch", zap.String("source", source))
+		p.recordDrops(item.origin, dropReasonGlobalFull, 1)
+		return false, errGlobalFull
+	}
+	p.admit(item)
+	return true, nil
+}
+
+// enqueueBlocking waits up to BlockTimeout for room, so the caller (and the
+// receiver in front of it) experiences backpressure instead of silent drops.
+func (p *weightedQueueProcessor) enqueueBlocking(ctx context.Context, source string, queue *dynamicQueue, item queueItem) (bool, error) {
+	timer := time.NewTimer(p.config.Overflow.BlockTimeout)
+	defer timer.Stop()
+
+	for {
+		space := p.spaceFreed()
+		if batches, bytes := p.globalExcess(item); batches == 0 && bytes == 0 && queue.enqueue(item) {
+			p.admit(item)
+			return true, nil
+		}
+		if queue.isClosed() {
+			return false, errQueueClosed
+		}
+
+		select {
+		case <-space:
+		case <-timer.C:
+			p.logger.Warn("Timed out waiting for queue capacity, dropping batch", zap.String("source", source))
+			p.recordDrops(item.origin, dropReasonBlockTimeout, 1)
+			return false, errors.New("timed out waiting for queue capacity: backpressure")
+		case <-ctx.Done():
+			p.recordDrops(item.origin, dropReasonBlockTimeout, 1)
+			return false, ctx.Err()
+		case <-p.shutdownCh:
+			p.recordDrops(item.origin, dropReasonShutdown, 1)
+			return false, errShuttingDown
+		}
+	}
+}
+
+// spaceFreed returns a channel that is closed the next time a batch leaves
+// any queue
+func (p *weightedQueueProcessor) spaceFreed() <-chan struct{} {
+	p.spaceMu.Lock()
+	defer p.spaceMu.Unlock()
+	if p.spaceCh == nil {
+		p.spaceCh = make(chan struct{})
+	}
+	return p.spaceCh
+}
+
+// signalSpace wakes up enqueuers blocked on a full queue
+func (p *weightedQueueProcessor) signalSpace() {
+	p.spaceMu.Lock()
+	defer p.spaceMu.Unlock()
+	if p.spaceCh != nil {
+		close(p.spaceCh)
+		p.spaceCh = nil
+	}
+}
+
+// discard accounts for queued or in-flight batches that leave the processor
+// without being forwarded. Drops are recorded per source the batches were
+// received from.
+func (p *weightedQueueProcessor) discard(reason string, items ...queueItem) {
+	if len(items) == 0 {
+		return
+	}
+	p.release(items...)
+	perOrigin := make(map[string]int)
+	for _, item := range items {
+		perOrigin[item.origin]++
+	}
+	for origin, n := range perOrigin {
+		p.recordDrops(origin, reason, n)
+	}
+}
+
+// release removes items from the global totals and the domain's pending
+// batches, and wakes up enqueuers blocked on the global capacity
+func (p *weightedQueueProcessor) release(items ...queueItem) {
+	var bytes int64
+	perSource := make(map[string]int)
+	for _, item := range items {
+		bytes += item.bytes
+		perSource[item.source]++
+	}
+	p.totalEnqueued.Add(-int64(len(items)))
+	p.totalBytes.Add(-bytes)
+	for source, n := range perSource {
+		p.domain.AddPending(source, -n)
+	}
+	p.signalSpace()
+}
+
+func (p *weightedQueueProcessor) recordDrops(source, reason string, n int) {
+	p.droppedBatchesCounter.Add(context.Background(), int64(n),
+		p.attrs(source, attribute.String("reason", reason)),
+	)
+}
@@ -3,91 +3,107 @@ package weightedqueueprocessor
 import (
 	"context"
 	"errors"
-	"math/rand"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
 	"sync"
 	"sync/atomic"
 	"time"
 
 	weightupdateextension "github.com/alexandrosst/weightupdateextension"
 
+	"go.opentelemetry.io/collector/client"
 	"go.opentelemetry.io/collector/component"
 	"go.opentelemetry.io/collector/consumer"
+	"go.opentelemetry.io/collector/consumer/consumererror"
+	"go.opentelemetry.io/collector/pdata/pcommon"
+	"go.opentelemetry.io/collector/pdata/plog"
 	"go.opentelemetry.io/collector/pdata/pmetric"
+	"go.opentelemetry.io/collector/pdata/ptrace"
 	"go.uber.org/zap"
 
 	"go.opentelemetry.io/otel/attribute"
 	"go.opentelemetry.io/otel/metric"
 )
 
-// dynamicQueue for resizable queues
-type dynamicQueue struct {
-	mu    sync.Mutex
-	items []pmetric.Metrics
-	cap   int
-}
-
-func (q *dynamicQueue) enqueue(item pmetric.Metrics) bool {
-	q.mu.Lock()
-	defer q.mu.Unlock()
-	if len(q.items) >= q.cap {
-		return false
-	}
-	q.items = append(q.items, item)
-	return true
-}
-
-func (q *dynamicQueue) dequeue() (pmetric.Metrics, bool) {
-	q.mu.Lock()
-	defer q.mu.Unlock()
-	if len(q.items) == 0 {
-		return pmetric.Metrics{}, false
-	}
-	item := q.items[0]
-	q.items = q.items[1:]
-	return item, true
-}
-
-func (q *dynamicQueue) len() int {
-	q.mu.Lock()
-	defer q.mu.Unlock()
-	return len(q.items)
-}
-
-func (q *dynamicQueue) setCap(newCap int) {
-	q.mu.Lock()
-	defer q.mu.Unlock()
-	q.cap = newCap
-	if len(q.items) > q.cap {
-		q.items = q.items[:q.cap] // Trim excess
-	}
-}
-
-func (q *dynamicQueue) close() {
-	q.mu.Lock()
-	defer q.mu.Unlock()
-	q.items = nil
-}
-
 type weightedQueueProcessor struct {
 	config                  *Config
-	nextConsumer            consumer.Metrics
+	domain                  *weightupdateextension.Domain // weights, SLOs, priorities and rate limits, see Config.WeightDomain
+	signal                  signalKind
+	tenantKeys              []weightupdateextension.TenantKeyRule  // how resources map to sources
+	classes                 *classifier                            // how sources map to scheduling classes
+	consume                 func(context.Context, telemetry) error // passes a batch to the next consumer
 	logger                  *zap.Logger
 	shutdownCh              chan struct{}
+	notifyCh                chan struct{} // signals the dequeue loop that data was enqueued
 	wg                      sync.WaitGroup
 	queues                  sync.Map                    // map[string]*dynamicQueue
+	queuesMu                sync.Mutex                  // serializes queue creation, see queueFor
 	totalEnqueued           atomic.Int64                // Total batches across queues
+	totalBytes              atomic.Int64                // Total bytes across queues
 	droppedBatchesCounter   metric.Int64Counter         // total drops
+	unattributedCounter     metric.Int64Counter         // resources matching no tenant key rule
+	tenantLimitedCounter    metric.Int64Counter         // resources of sources beyond max_tenants
 	queueLengthGauge        metric.Int64ObservableGauge // per-source length
+	queueBytesGauge         metric.Int64ObservableGauge // per-source queued bytes
 	forwardedBatchesCounter metric.Int64Counter         // total forwarded
+	forwardedCostCounter    metric.Int64Counter         // forwarded cost in config.CostUnit
+	newScheduler            SchedulerFactory            // from config.Scheduler
+	schedMu                 sync.Mutex                  // serializes scheduler calls
+	tierSchedulers          map[int]Scheduler           // one scheduler per priority tier
+	tierWeights             map[int]map[string]float64  // weights last passed to each tier scheduler
+	view                    queueView                   // queues as seen by schedulers
+	limiter                 *rateLimiter                // per-source token buckets
+	throttledCounter        metric.Float64Counter       // per-source time spent rate limited
+	retry                   *retryTracker               // per-source backoff after failed forwards
+	retriedBatchesCounter   metric.Int64Counter         // total re-queued after a retryable failure
+	inFlight                *inFlightLimiter            // per-source forwards in progress
+	paceMu                  sync.Mutex                  // guards nextSlot
+	nextSlot                time.Time                   // earliest start of the next forward under MaxBatchesPerSecond
+	spaceMu                 sync.Mutex                  // guards spaceCh
+	spaceCh                 chan struct{}               // closed when a batch leaves a queue, see spaceFreed
+
+	// Aging, see Config.Aging
+	effectiveWeights     map[string]float64            // weights after aging, guarded by schedMu
+	agedBatchesCounter   metric.Int64Counter           // batches served because they waited aging.max_wait
+	effectiveWeightGauge metric.Float64ObservableGauge // per-source weight after aging
 }
 
 func (p *weightedQueueProcessor) Capabilities() consumer.Capabilities {
 	return consumer.Capabilities{MutatesData: false}
 }
 
-func (p *weightedQueueProcessor) Start(ctx context.Context, _ component.Host) error {
-	p.wg.Add(1)
-	go p.dequeueLoop()
+func (p *weightedQueueProcessor) Start(ctx context.Context, host component.Host) error {
+	domain, err := weightupdateextension.DomainFromHost(host, p.config.WeightDomain, p.logger)
+	if err != nil {
+		return err
+	}
+	p.domain = domain
+	p.view = queueView{queues: &p.queues, limiter: p.limiter, retry: p.retry, inFlight: p.inFlight, domain: domain}
+
+	for source, limit := range p.config.RateLimits {
+		if err := p.domain.SetRateLimitForTenant(source, limit); err != nil {
+			p.logger.Warn("Failed to apply initial rate limit from config", zap.String("source", source), zap.Error(err))
+		}
+	}
+	for source, tier := range p.config.Priorities {
+		if err := p.domain.SetPriorityForTenant(source, tier); err != nil {
+			p.logger.Warn("Failed to apply initial priority from config", zap.String("source", source), zap.Error(err))
+		}
+	}
+
+	p.seedWeights()
+
+	if err := p.restoreQueues(); err != nil {
+		return err
+	}
+
+	for i := 0; i < p.config.NumConsumers; i++ {
+		p.wg.Add(1)
+		go p.dequeueLoop()
+	}
 	p.wg.Add(1)
 	go p.monitorSharedChanges()
 	return nil
@@ -97,87 +113,353 @@ func (p *weightedQueueProcessor) Shutdown(ctx context.Context) error {
 	close(p.shutdownCh)
 	p.wg.Wait()
 	p.queues.Range(func(key, value any) bool {
-		value.(*dynamicQueue).close()
+		q := value.(*dynamicQueue)
+		if p.config.Persistence.Directory != "" {
+			if n := q.persist(); n > 0 {
+				p.domain.AddPending(key.(string), -n)
+				p.logger.Info("Persisted queued batches for next start", zap.String("source", key.(string)), zap.Int("batches", n))
+			}
+			return true
+		}
+		p.discard(dropReasonShutdown, q.close()...)
 		return true
 	})
 	return nil
 }
 
-func (p *weightedQueueProcessor) calculateInitialCap() int {
-	weightupdateextension.GlobalWeights.RLock()
-	num := weightupdateextension.GlobalWeights.NumSources
-	weightupdateextension.GlobalWeights.RUnlock()
-	if num == 0 {
+// walDir returns where this signal's WALs are kept, or "" without persistence
+func (p *weightedQueueProcessor) walDir() string {
+	if p.config.Persistence.Directory == "" {
+		return ""
+	}
+	return filepath.Join(p.config.Persistence.Directory, p.signal.name)
+}
+
+// restoreQueues recreates the queues of every source with a WAL in the
+// persistence directory, in their original order
+func (p *weightedQueueProcessor) restoreQueues() error {
+	dir := p.walDir()
+	if dir == "" {
+		return nil
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return fmt.Errorf("failed to create persistence directory: %w", err)
+	}
+	sources, err := persistedSources(dir)
+	if err != nil {
+		return fmt.Errorf("failed to list persisted queues: %w", err)
+	}
+	for _, source := range sources {
+		p.queueFor(source)
+	}
+	return nil
+}
+
+// queueFor returns the queue of source, creating it on first use. With
+// persistence, a new queue opens its WAL and restores the batches it holds.
+func (p *weightedQueueProcessor) queueFor(source string) *dynamicQueue {
+	if qIface, ok := p.queues.Load(source); ok {
+		return qIface.(*dynamicQueue)
+	}
+
+	p.queuesMu.Lock()
+	defer p.queuesMu.Unlock()
+	if qIface, ok := p.queues.Load(source); ok {
+		return qIface.(*dynamicQueue)
+	}
+
+	queue := &dynamicQueue{cap: p.calculateInitialCap(source), maxBytes: p.maxQueueBytes(source)}
+	var restored []queueItem
+	if dir := p.walDir(); dir != "" {
+		wal, items, err := openWAL(dir, source, p.logger, p.signal.unmarshal, p.config.Persistence.Fsync)
+		if err != nil {
+			p.logger.Error("Failed to open queue WAL, source will not be persisted", zap.String("source", source), zap.Error(err))
+		} else {
+			for i := range items {
+				items[i] = p.newQueueItem(items[i].data, source, items[i].origin, items[i].info, items[i].enqueuedAt, items[i].seq)
+			}
+			queue.restore(wal, items)
+			restored = items
+		}
+	}
+	p.queues.Store(source, queue)
+	for _, item := range restored {
+		p.admit(item)
+	}
+	p.maybeAddSource(source)
+
+	if len(restored) > 0 {
+		for _, item := range restored {
+			p.onEnqueue(source, item)
+		}
+		p.notify()
+		p.logger.Info("Restored persisted batches", zap.String("source", source), zap.Int("batches", len(restored)))
+	}
+	return queue
+}
+
+// maxQueueBytes returns the byte limit of source's queue, 0 if unlimited
+func (p *weightedQueueProcessor) maxQueueBytes(source string) int64 {
+	if limit, ok := p.config.SourceMaxQueueBytes[source]; ok {
+		return limit
+	}
+	return p.config.MaxQueueBytes
+}
+
+func (p *weightedQueueProcessor) calculateInitialCap(source string) int {
+	weights := p.snapshotWeights()
+	if _, ok := weights[source]; ok {
+		return p.queueCaps(weights)[source]
+	}
+	if len(weights) == 0 {
 		return 100 // Fallback if no sources yet
 	}
-	return p.config.MaxTotalCapacity / num
+	return p.config.MaxTotalCapacity / len(weights)
 }
 
-func (p *weightedQueueProcessor) ConsumeMetrics(_ context.Context, md pmetric.Metrics) error {
+func (p *weightedQueueProcessor) ConsumeMetrics(ctx context.Context, md pmetric.Metrics) error {
 	rms := md.ResourceMetrics()
 	for i := 0; i < rms.Len(); i++ {
 		rm := rms.At(i)
-		sourceVal, ok := rm.Resource().Attributes().Get(p.config.SourceAttribute)
+		source, ok := p.tenantOf(rm.Resource().Attributes())
 		if !ok {
-			p.logger.Warn("Missing source attribute, skipping", zap.String("attr", p.config.SourceAttribute))
 			continue
 		}
-		source := sourceVal.Str()
 
-		// Get or create queue
-		qIface, loaded := p.queues.LoadOrStore(source, &dynamicQueue{cap: p.calculateInitialCap()})
-		queue := qIface.(*dynamicQueue)
-		if !loaded {
-			p.maybeAddSource(source)
+		cloned := pmetric.NewMetrics()
+		rm.CopyTo(cloned.ResourceMetrics().AppendEmpty())
+		if err := p.consumeResource(ctx, source, metricsBatch{cloned}); err != nil {
+			return err
 		}
+	}
+	return nil
+}
 
-		// Check global total before enqueue
-		if p.totalEnqueued.Load()+1 > int64(p.config.MaxTotalCapacity) {
-			p.logger.Warn("Global capacity exceeded, dropping batch", zap.String("source", source))
-			p.droppedBatchesCounter.Add(context.Background(), 1, metric.WithAttributes(attribute.String("source", source)))
-			return errors.New("global queue full: backpressure")
+func (p *weightedQueueProcessor) ConsumeTraces(ctx context.Context, td ptrace.Traces) error {
+	rss := td.ResourceSpans()
+	for i := 0; i < rss.Len(); i++ {
+		rs := rss.At(i)
+		source, ok := p.tenantOf(rs.Resource().Attributes())
+		if !ok {
+			continue
 		}
 
-		// Clone and enqueue, check per-queue
-		cloned := pmetric.NewMetrics()
-		rm.CopyTo(cloned.ResourceMetrics().AppendEmpty())
-		if !queue.enqueue(cloned) {
-			p.logger.Warn("Per-queue capacity exceeded, dropping batch", zap.String("source", source))
-			p.droppedBatchesCounter.Add(context.Background(), 1, metric.WithAttributes(attribute.String("source", source)))
-			continue // Or return error for stricter
+		cloned := ptrace.NewTraces()
+		rs.CopyTo(cloned.ResourceSpans().AppendEmpty())
+		if err := p.consumeResource(ctx, source, tracesBatch{cloned}); err != nil {
+			return err
 		}
+	}
+	return nil
+}
+
+func (p *weightedQueueProcessor) ConsumeLogs(ctx context.Context, ld plog.Logs) error {
+	rls := ld.ResourceLogs()
+	for i := 0; i < rls.Len(); i++ {
+		rl := rls.At(i)
+		source, ok := p.tenantOf(rl.Resource().Attributes())
+		if !ok {
+			continue
+		}
+
+		cloned := plog.NewLogs()
+		rl.CopyTo(cloned.ResourceLogs().AppendEmpty())
+		if err := p.consumeResource(ctx, source, logsBatch{cloned}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// tenantOf returns the source of a resource. Resources that match no tenant
+// key rule are counted and go to the unassigned tenant when it is enabled.
+func (p *weightedQueueProcessor) tenantOf(attrs pcommon.Map) (string, bool) {
+	if source, ok := weightupdateextension.ResolveTenant(attrs, p.tenantKeys); ok {
+		return source, true
+	}
+	p.unattributedCounter.Add(context.Background(), 1,
+		metric.WithAttributes(attribute.String("signal", p.signal.name)),
+	)
+	if !p.config.UnassignedTenant.Enabled {
+		p.logger.Warn("No tenant key rule matched, skipping", zap.Any("tenant_keys", p.tenantKeys))
+		return "", false
+	}
+	p.logger.Debug("No tenant key rule matched, routing to the unassigned tenant", zap.String("source", p.config.UnassignedTenant.Name))
+	return p.config.UnassignedTenant.Name, true
+}
 
-		p.totalEnqueued.Add(1)
+// consumeResource enqueues the cloned batch of one resource received from
+// origin under its queue's overflow policy. The queue is the one of origin's
+// scheduling class, or of origin itself when no class rule matches.
+func (p *weightedQueueProcessor) consumeResource(ctx context.Context, origin string, data telemetry) error {
+	source := p.classes.classOf(origin)
+	// Touch before looking up the weight, so idle expiry either sees the
+	// new data or has removed the source before admitTenant adds it back
+	p.domain.TouchTenant(source)
+	admitted, ok := p.admitTenant(source)
+	if admitted != source {
+		// Sources over the tenant limit are not tracked
+		p.domain.ForgetTenant(source)
+	}
+	if !ok {
+		return nil
+	}
+	if admitted != source {
+		// Batches sent to the unassigned tenant are also reported under it,
+		// so bogus source IDs never show up as metric attributes
+		source, origin = admitted, admitted
+		p.domain.TouchTenant(source)
+	}
+	item := p.newQueueItem(data, source, origin, p.clientInfo(ctx), time.Now(), 0)
+	var queued bool
+	var err error
+	for {
+		select {
+		case <-p.shutdownCh:
+			p.recordDrops(item.origin, dropReasonShutdown, 1)
+			return errShuttingDown
+		default:
+		}
+		// cleanDeletedQueues may close the queue of a removed source before
+		// the batch gets in; the next queueFor then opens a new one
+		queued, err = p.enqueue(ctx, source, p.queueFor(source), item)
+		if !errors.Is(err, errQueueClosed) {
+			break
+		}
+	}
+	if err != nil || !queued {
+		return err
 	}
+
+	p.onEnqueue(source, item)
+	p.notify()
 	return nil
 }
 
+// newQueueItem wraps a single-resource batch with its scheduling metadata.
+// Schedulers charge the batch's cost in the configured cost unit against the
+// source's share, so weights describe a share of forwarded data points,
+// spans, log records or bytes rather than of batches.
+func (p *weightedQueueProcessor) newQueueItem(data telemetry, source, origin string, info client.Info, enqueuedAt time.Time, seq uint64) queueItem {
+	return queueItem{
+		data:       data,
+		source:     source,
+		origin:     origin,
+		info:       info,
+		cost:       data.cost(p.config.CostUnit),
+		enqueuedAt: enqueuedAt,
+		initialTs:  data.initialTimestamp(),
+		count:      data.count(),
+		bytes:      int64(data.size()),
+		seq:        seq,
+	}
+}
+
+// initialTimestamp returns the initial_timestamp data point attribute set by
+// an upstream collector, as read by the freshness exporter.
+func initialTimestamp(md pmetric.Metrics) int64 {
+	rms := md.ResourceMetrics()
+	for i := 0; i < rms.Len(); i++ {
+		sms := rms.At(i).ScopeMetrics()
+		for j := 0; j < sms.Len(); j++ {
+			metrics := sms.At(j).Metrics()
+			for k := 0; k < metrics.Len(); k++ {
+				var dps pmetric.NumberDataPointSlice
+				switch m := metrics.At(k); m.Type() {
+				case pmetric.MetricTypeSum:
+					dps = m.Sum().DataPoints()
+				case pmetric.MetricTypeGauge:
+					dps = m.Gauge().DataPoints()
+				default:
+					continue
+				}
+				if dps.Len() == 0 {
+					continue
+				}
+				if v, ok := dps.At(0).Attributes().Get("initial_timestamp"); ok && v.Type() == pcommon.ValueTypeInt {
+					return v.Int()
+				}
+			}
+		}
+	}
+	return 0
+}
+
+// batchInfo describes a queued item to schedulers. The deadline uses the
+// current SLO threshold in domain of the tenant the batch came from, so
+// runtime SLO updates apply to batches that are already queued.
+func batchInfo(domain *weightupdateextension.Domain, item queueItem) BatchInfo {
+	origin := item.enqueuedAt
+	if item.initialTs > 0 {
+		origin = time.Unix(0, item.initialTs)
+	}
+	return BatchInfo{
+		Cost:       item.cost,
+		EnqueuedAt: item.enqueuedAt,
+		Deadline:   origin.Add(time.Duration(domain.GetSLOThresholdForTenant(item.origin))),
+	}
+}
+
+// admitTenant decides whether data of source may be queued. With
+// max_tenants, a source without a weight is only added while fewer than
+// MaxTenants sources have one; otherwise its data is rejected or, with the
+// overflow admission policy, handed to the unassigned tenant.
+func (p *weightedQueueProcessor) admitTenant(source string) (string, bool) {
+	if p.config.MaxTenants <= 0 || p.addSource(source, p.config.MaxTenants) {
+		return source, true
+	}
+	p.tenantLimitedCounter.Add(context.Background(), 1, metric.WithAttributes(
+		attribute.String("signal", p.signal.name),
+		attribute.String("policy", p.config.TenantAdmission),
+	))
+	if p.config.TenantAdmission == TenantAdmissionOverflow {
+		return p.config.UnassignedTenant.Name, true
+	}
+	p.logger.Debug("Tenant limit reached, rejecting data of new source", zap.String("source", source), zap.Int("max_tenants", p.config.MaxTenants))
+	return "", false
+}
+
 func (p *weightedQueueProcessor) maybeAddSource(source string) {
-	weightupdateextension.GlobalWeights.RLock()
-	_, exists := weightupdateextension.GlobalWeights.Weights[source]
-	weightupdateextension.GlobalWeights.RUnlock()
+	p.addSource(source, 0)
+}
+
+// addSource gives source a weight if it has none, following the onboarding
+// policy. It reports false, without adding source, if limit sources
+// already have a weight; 0 is unlimited and the unassigned tenant is never
+// limited.
+func (p *weightedQueueProcessor) addSource(source string, limit int) bool {
+	p.domain.Weights.RLock()
+	_, exists := p.domain.Weights.Weights[source]
+	p.domain.Weights.RUnlock()
 
 	if exists {
-		return
+		return true
 	}
 
-	weightupdateextension.GlobalWeights.Lock()
-	n := len(weightupdateextension.GlobalWeights.Weights)
-	if n == 0 {
-		weightupdateextension.GlobalWeights.Weights[source] = 1.0
-	} else {
-		equal := 1.0 / float64(n+1)
-		for k := range weightupdateextension.GlobalWeights.Weights {
-			weightupdateextension.GlobalWeights.Weights[k] = equal
-		}
-		weightupdateextension.GlobalWeights.Weights[source] = equal
+	p.domain.Weights.Lock()
+	weights := p.domain.Weights.Weights
+	if _, exists := weights[source]; exists {
+		p.domain.Weights.Unlock()
+		return true
+	}
+	if limit > 0 && len(weights) >= limit && !p.isUnassigned(source) {
+		p.domain.Weights.Unlock()
+		return false
 	}
-	weightupdateextension.GlobalWeights.NumSources = n + 1
-	weightupdateextension.GlobalWeights.Unlock()
+	p.onboard(p.domain.Weights, source)
+	p.domain.TouchTenant(source)
+	p.domain.Weights.NumSources = len(weights)
+	p.domain.Weights.Unlock()
+	p.domain.Weights.NotifyChanged()
 
 	p.updateQueueCaps()
 
-	p.logger.Info("New source added, weights rebalanced", zap.String("source", source), zap.Int("total", weightupdateextension.GlobalWeights.NumSources))
+	p.logger.Info("New source added, weights rebalanced", zap.String("source", source), zap.String("onboarding", p.config.Onboarding.Policy), zap.Int("total", p.domain.Weights.NumSources))
+	return true
+}
+
+func (p *weightedQueueProcessor) isUnassigned(source string) bool {
+	return p.config.UnassignedTenant.Enabled && source == p.config.UnassignedTenant.Name
 }
 
 func (p *weightedQueueProcessor) monitorSharedChanges() {
@@ -189,22 +471,63 @@ func (p *weightedQueueProcessor) monitorSharedChanges() {
 		select {
 		case <-p.shutdownCh:
 			return
+		case <-p.domain.Weights.Changed():
+			p.updateQueueCaps()
 		case <-ticker.C:
+			p.shedExpired(false)
+			p.expireIdleTenants()
 			p.cleanDeletedQueues()
 			p.updateQueueCaps()
 		}
 	}
 }
 
+// expireIdleTenants removes the weight and SLO of every source that sent no
+// data, to any pipeline, for IdleTenantTimeout. Sources with batches queued
+// or in flight in any pipeline of the domain are kept until those drain.
+// Priorities, rate limits, pinned weights and SLOs seeded from config are
+// set by operators and survive expiry.
+func (p *weightedQueueProcessor) expireIdleTenants() {
+	timeout := p.config.IdleTenantTimeout
+	if timeout <= 0 {
+		return
+	}
+	for _, source := range p.domain.IdleTenants(timeout) {
+		p.domain.Weights.Lock()
+		// Re-check under the lock new data takes after touching its source,
+		// see consumeResource
+		if !p.domain.IsIdle(source, timeout) {
+			p.domain.Weights.Unlock()
+			continue
+		}
+		weights := p.domain.Weights.Weights
+		_, exists := weights[source]
+		if exists {
+			p.offboard(p.domain.Weights, source)
+			p.domain.Weights.NumSources = len(weights)
+		}
+		p.domain.ForgetTenant(source)
+		p.domain.Weights.Unlock()
+		p.domain.ResetSLOThresholdForTenant(source)
+		if !exists {
+			continue
+		}
+		p.domain.Weights.NotifyChanged()
+
+		p.logger.Info("Removed idle source, weights rebalanced", zap.String("source", source), zap.Duration("idle_timeout", timeout))
+	}
+}
+
 func (p *weightedQueueProcessor) cleanDeletedQueues() {
 	p.queues.Range(func(key, value any) bool {
 		source := key.(string)
-		weightupdateextension.GlobalWeights.RLock()
-		_, exists := weightupdateextension.GlobalWeights.Weights[source]
-		weightupdateextension.GlobalWeights.RUnlock()
+		p.domain.Weights.RLock()
+		_, exists := p.domain.Weights.Weights[source]
+		p.domain.Weights.RUnlock()
 		if !exists {
-			value.(*dynamicQueue).close()
+			p.discard(dropReasonSourceDeleted, value.(*dynamicQueue).close()...)
 			p.queues.Delete(key)
+			p.retry.forget(source)
 			p.logger.Info("Deleted queue for removed source", zap.String("source", source))
 		}
 		return true
@@ -212,88 +535,530 @@ func (p *weightedQueueProcessor) cleanDeletedQueues() {
 }
 
 func (p *weightedQueueProcessor) updateQueueCaps() {
-	weightupdateextension.GlobalWeights.RLock()
-	num := weightupdateextension.GlobalWeights.NumSources
-	weightupdateextension.GlobalWeights.RUnlock()
-
-	if num == 0 {
+	weights := p.snapshotWeights()
+	if len(weights) == 0 {
 		return
 	}
-	perQueueCap := p.config.MaxTotalCapacity / num
+	caps := p.queueCaps(weights)
 
 	p.queues.Range(func(key, value any) bool {
-		queue := value.(*dynamicQueue)
-		queue.setCap(perQueueCap)
+		source := key.(string)
+		if c, ok := caps[source]; ok {
+			trimOldest := p.overflowPolicy(source) == OverflowDropOldest
+			p.discard(dropReasonCapacityShrink, value.(*dynamicQueue).setCap(c, trimOldest)...)
+		}
 		return true
 	})
 
-	p.logger.Debug("Updated per-queue capacities equally", zap.Int("per_queue", perQueueCap))
+	p.logger.Debug("Updated per-queue capacities", zap.String("policy", p.config.CapacityPolicy), zap.Any("caps", caps))
+}
+
+// queueCaps splits MaxTotalCapacity across the weighted sources according
+// to the capacity policy:
+//   - equal: every source gets the same share
+//   - weighted: shares proportional to weight, at least 1 for positive weights
+//   - weighted_with_floor: every source first gets MinQueueCapacity, the
+//     remainder is split proportionally to weight
+//
+// An unassigned tenant with a configured capacity is set aside first.
+func (p *weightedQueueProcessor) queueCaps(weights map[string]float64) map[string]int {
+	total := p.config.MaxTotalCapacity
+	u := p.config.UnassignedTenant
+	if _, ok := weights[u.Name]; !ok || !u.Enabled || u.Capacity <= 0 {
+		return p.splitCapacity(weights, total)
+	}
+
+	others := maps.Clone(weights)
+	delete(others, u.Name)
+	caps := p.splitCapacity(others, total-u.Capacity)
+	caps[u.Name] = u.Capacity
+	return caps
 }
 
+func (p *weightedQueueProcessor) splitCapacity(weights map[string]float64, total int) map[string]int {
+	caps := make(map[string]int, len(weights))
+	if len(weights) == 0 {
+		return caps
+	}
+
+	var sum float64
+	for _, w := range weights {
+		sum += w
+	}
+	if p.config.CapacityPolicy == CapacityEqual || sum <= 0 {
+		for source := range weights {
+			caps[source] = total / len(weights)
+		}
+		return caps
+	}
+
+	floor := 0
+	if p.config.CapacityPolicy == CapacityWeightedWithFloor {
+		floor = min(p.config.MinQueueCapacity, total/len(weights))
+	}
+	shared := total - floor*len(weights)
+
+	for source, w := range weights {
+		c := floor + int(w/sum*float64(shared))
+		if c == 0 && w > 0 {
+			c = 1
+		}
+		caps[source] = c
+	}
+	return caps
+}
+
+// dequeueLoop is one of NumConsumers workers draining the queues whenever
+// any of them holds data. It sleeps until an enqueue signals new data,
+// re-checking every PollIntervalMs in case weights or priorities changed.
+// All workers share the schedulers, so the weights apply to their combined
+// output.
 func (p *weightedQueueProcessor) dequeueLoop() {
 	defer p.wg.Done()
-	ticker := time.NewTicker(time.Duration(p.config.PollIntervalMs) * time.Millisecond)
-	defer ticker.Stop()
+	idle := time.NewTicker(time.Duration(p.config.PollIntervalMs) * time.Millisecond)
+	defer idle.Stop()
 
 	for {
-		select {
-		case <-p.shutdownCh:
-			return
-		case <-ticker.C:
-			source := p.selectWeightedSource()
-			if source == "" {
-				continue
+		for {
+			select {
+			case <-p.shutdownCh:
+				return
+			default:
 			}
 
-			qIface, ok := p.queues.Load(source)
+			source, queue, items, ok := p.nextBatch()
 			if !ok {
-				continue
+				break
 			}
-			queue := qIface.(*dynamicQueue)
+			// Let an idle worker look for the next batch meanwhile
+			p.notify()
+			// The source queue has room again; the global capacity only
+			// frees up once the forward finished, see release
+			p.signalSpace()
 
-			batch, ok := queue.dequeue()
-			if !ok {
-				continue
+			if !p.awaitSlot(len(items)) {
+				// Shutting down: keep the batches for Shutdown to persist or drop
+				p.inFlight.release(source, len(items))
+				p.requeue(queue, dropReasonShutdown, items)
+				return
 			}
+			p.forward(source, queue, items)
+		}
 
-			if err := p.nextConsumer.ConsumeMetrics(context.Background(), batch); err != nil {
-				p.logger.Error("Failed to forward batch", zap.Error(err))
-			} else {
-				p.totalEnqueued.Add(-1)
-				p.forwardedBatchesCounter.Add(context.Background(), 1,
-					metric.WithAttributes(attribute.String("source", source)),
-				)
-			}
+		// Wake up early when a rate limited or backing off source can
+		// forward again
+		var release <-chan time.Time
+		var timer *time.Timer
+		wait := p.limiter.nextRelease()
+		if r := p.retry.nextRelease(); r > 0 && (wait == 0 || r < wait) {
+			wait = r
+		}
+		if wait > 0 {
+			timer = time.NewTimer(wait)
+			release = timer.C
+		}
+
+		select {
+		case <-p.shutdownCh:
+			return
+		case <-p.notifyCh:
+		case <-idle.C:
+		case <-release:
+		}
+		if timer != nil {
+			timer.Stop()
 		}
 	}
 }
 
-func (p *weightedQueueProcessor) selectWeightedSource() string {
-	weightupdateextension.GlobalWeights.RLock()
-	weights := make(map[string]float64, len(weightupdateextension.GlobalWeights.Weights))
-	for k, v := range weightupdateextension.GlobalWeights.Weights {
-		weights[k] = v
+// awaitSlot paces the workers together to MaxBatchesPerSecond. A forward of
+// n coalesced batches takes n slots, delaying the forward after it. It
+// reports false if the processor shuts down while waiting.
+func (p *weightedQueueProcessor) awaitSlot(n int) bool {
+	if p.config.MaxBatchesPerSecond <= 0 {
+		return true
 	}
-	weightupdateextension.GlobalWeights.RUnlock()
-	if len(weights) == 0 {
-		return ""
+	interval := time.Duration(float64(time.Second) / p.config.MaxBatchesPerSecond)
+
+	p.paceMu.Lock()
+	slot := time.Now()
+	if p.nextSlot.After(slot) {
+		slot = p.nextSlot
 	}
+	p.nextSlot = slot.Add(time.Duration(n) * interval)
+	p.paceMu.Unlock()
 
-	var total float64
-	for _, w := range weights {
-		total += w
+	wait := time.Until(slot)
+	if wait <= 0 {
+		return true
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-p.shutdownCh:
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+// forward passes batches dequeued from source downstream, merged into one
+// batch if several were coalesced. The batches keep counting against the
+// global capacity until they were forwarded or dropped.
+func (p *weightedQueueProcessor) forward(source string, queue *dynamicQueue, items []queueItem) {
+	defer func() {
+		if p.inFlight.release(source, len(items)) {
+			p.notify()
+		}
+	}()
+	data := items[0].data
+	if len(items) > 1 {
+		batches := make([]telemetry, len(items))
+		for i, item := range items {
+			batches[i] = item.data
+		}
+		data = p.signal.merge(batches)
+	}
+
+	// The merged batches share their client, see coalesce
+	err := p.consume(client.NewContext(context.Background(), items[0].info), data)
+	switch {
+	case err == nil:
+		p.retry.succeeded(source)
+		queue.ack(items...)
+		p.release(items...)
+		for _, item := range items {
+			p.forwardedBatchesCounter.Add(context.Background(), 1, p.attrs(item.origin))
+			p.forwardedCostCounter.Add(context.Background(), int64(item.cost), p.attrs(item.origin))
+		}
+	case consumererror.IsPermanent(err):
+		p.logger.Error("Batch rejected permanently, dropping", zap.String("source", source), zap.Int("batches", len(items)), zap.Error(err))
+		p.dropInFlight(queue, dropReasonPermanentError, items...)
+	default:
+		p.retryBatch(source, queue, items, err)
+	}
+}
+
+// retryBatch re-queues batches whose forward failed with a retryable error
+// at the head of their queue and backs the source off, or drops them once
+// retry is disabled, a batch ran out of attempts or the source out of
+// budget. Coalesced batches are retried together, counting one failure.
+func (p *weightedQueueProcessor) retryBatch(source string, queue *dynamicQueue, items []queueItem, err error) {
+	if !p.config.Retry.Enabled {
+		p.logger.Error("Failed to forward batch, dropping", zap.String("source", source), zap.Int("batches", len(items)), zap.Error(err))
+		p.dropInFlight(queue, dropReasonRetryDisabled, items...)
+		return
+	}
+	retry := items[:0:0]
+	for _, item := range items {
+		item.attempts++
+		if p.config.Retry.MaxAttempts > 0 && item.attempts >= p.config.Retry.MaxAttempts {
+			p.logger.Error("Failed to forward batch, attempts exhausted, dropping", zap.String("source", source), zap.Int("attempts", item.attempts), zap.Error(err))
+			p.dropInFlight(queue, dropReasonMaxAttempts, item)
+			continue
+		}
+		retry = append(retry, item)
+	}
+	if len(retry) == 0 {
+		return
+	}
+	backoff, ok := p.retry.failed(source)
+	if !ok {
+		p.logger.Error("Failed to forward batch, retry budget exhausted, dropping", zap.String("source", source), zap.Int("batches", len(retry)), zap.Error(err))
+		p.dropInFlight(queue, dropReasonRetryBudget, retry...)
+		return
+	}
+	requeued := p.requeue(queue, dropReasonSourceDeleted, retry)
+	for _, item := range requeued {
+		p.retriedBatchesCounter.Add(context.Background(), 1, p.attrs(item.origin))
+	}
+	if len(requeued) > 0 {
+		p.logger.Warn("Failed to forward batch, retrying", zap.String("source", source), zap.Int("batches", len(requeued)), zap.Int("attempt", requeued[0].attempts), zap.Duration("backoff", backoff), zap.Error(err))
+	}
+}
+
+// dropInFlight discards items dequeued from queue and removes them from its
+// WAL
+func (p *weightedQueueProcessor) dropInFlight(queue *dynamicQueue, reason string, items ...queueItem) {
+	queue.ack(items...)
+	p.discard(reason, items...)
+}
+
+// requeue puts items back at the head of queue in their original order and
+// returns those it accepted. Items the closed queue rejects are discarded
+// with reason.
+func (p *weightedQueueProcessor) requeue(queue *dynamicQueue, reason string, items []queueItem) []queueItem {
+	requeued := make([]queueItem, 0, len(items))
+	for i := len(items) - 1; i >= 0; i-- {
+		if !queue.requeue(items[i]) {
+			p.discard(reason, items[i])
+			continue
+		}
+		requeued = append(requeued, items[i])
 	}
-	r := rand.Float64() * total
+	slices.Reverse(requeued)
+	return requeued
+}
 
-	var acc float64
-	for source, weight := range weights {
-		acc += weight
-		if r <= acc {
-			qIface, ok := p.queues.Load(source)
-			if ok && qIface.(*dynamicQueue).len() > 0 {
-				return source
+// notify wakes the dequeue loop without blocking the caller
+func (p *weightedQueueProcessor) notify() {
+	select {
+	case p.notifyCh <- struct{}{}:
+	default:
+	}
+}
+
+// nextBatch asks the scheduler of the highest non-empty priority tier which
+// source forwards next and dequeues that source's head batch, plus the
+// batches coalesced with it. Expired batches are dropped first, and a source
+// overdue under Config.Aging is served without asking, its head batch charged
+// through CoalescingScheduler. All of it happens under schedMu, so concurrent
+// workers never act on the same decision.
+func (p *weightedQueueProcessor) nextBatch() (string, *dynamicQueue, []queueItem, bool) {
+	p.shedExpired(true)
+
+	// Throttling is decided and charged under schedMu, so a worker never
+	// acts on a bucket another worker has already drained
+	p.schedMu.Lock()
+	defer p.schedMu.Unlock()
+	p.limiter.refresh(p.domain.RateLimits, &p.queues, p.recordThrottled)
+
+	all := p.snapshotWeights()
+	tier, weights := p.activeTierWeights(all)
+	weights, overdue := p.agedWeights(weights)
+	maps.Copy(all, weights)
+	p.effectiveWeights = all
+	if len(weights) == 0 {
+		return "", nil, nil, false
+	}
+	s := p.tierScheduler(tier)
+	if !maps.Equal(p.tierWeights[tier], weights) {
+		p.tierWeights[tier] = weights
+		s.OnWeightsChanged(weights)
+	}
+	if overdue != "" {
+		if qIface, ok := p.queues.Load(overdue); ok {
+			queue := qIface.(*dynamicQueue)
+			if item, ok := queue.dequeue(); ok {
+				if cs, ok := s.(CoalescingScheduler); ok {
+					// Served out of turn, but the scheduler still accounts
+					// for the batch like for the ones coalesced with it
+					cs.Coalesce(overdue, batchInfo(p.domain, item))
+				}
+				p.agedBatchesCounter.Add(context.Background(), 1, p.attrs(overdue))
+				p.logger.Debug("Serving source past aging max_wait", zap.String("source", overdue), zap.Duration("waited", time.Since(item.enqueuedAt)))
+				return overdue, queue, p.coalesce(s, overdue, queue, item), true
 			}
 		}
 	}
-	return ""
+	// The chosen queue may have been emptied by an eviction or a capacity
+	// shrink since the scheduler looked at it; then ask again
+	for range weights {
+		source := s.Next()
+		if source == "" {
+			break
+		}
+		qIface, ok := p.queues.Load(source)
+		if !ok {
+			break
+		}
+		queue := qIface.(*dynamicQueue)
+		if item, ok := queue.dequeue(); ok {
+			return source, queue, p.coalesce(s, source, queue, item), true
+		}
+	}
+	return "", nil, nil, false
+}
+
+// coalesce dequeues further batches of source behind first while they stay
+// within the coalesce limits, the source's rate and in-flight limits and, if
+// s implements CoalescingScheduler, the scheduler's consent. It stops at an
+// expired batch, left for the next decision to drop, and at a batch of
+// another client than first's, see sameClient. Every dequeued batch is
+// charged to the source's rate limit and in-flight count right away, so
+// concurrent workers see them before their next decision. Callers must hold
+// schedMu.
+func (p *weightedQueueProcessor) coalesce(s Scheduler, source string, queue *dynamicQueue, first queueItem) []queueItem {
+	p.limiter.take(source, first)
+	p.inFlight.acquire(source, 1)
+	items := []queueItem{first}
+	limits := p.config.Coalesce
+	if limits.MaxBatches <= 1 {
+		return items
+	}
+	cs, _ := s.(CoalescingScheduler)
+	count, bytes := first.count, first.bytes
+	for len(items) < limits.MaxBatches {
+		next, ok := queue.head()
+		if !ok || p.ttlEnabled() && p.isExpired(source, next, time.Now()) {
+			break
+		}
+		if !p.sameClient(first.info, next.info) {
+			break
+		}
+		if limits.MaxDataPoints > 0 && count+next.count > limits.MaxDataPoints {
+			break
+		}
+		if limits.MaxBytes > 0 && bytes+next.bytes > limits.MaxBytes {
+			break
+		}
+		if !p.limiter.fits(source, next) || p.inFlight.isFull(source) {
+			break
+		}
+		if cs != nil && !cs.Coalesce(source, batchInfo(p.domain, next)) {
+			break
+		}
+		// Only workers holding schedMu dequeue, but an eviction may have
+		// emptied the queue since head
+		item, ok := queue.dequeue()
+		if !ok {
+			break
+		}
+		p.limiter.take(source, item)
+		p.inFlight.acquire(source, 1)
+		items = append(items, item)
+		count += item.count
+		bytes += item.bytes
+	}
+	return items
+}
+
+// tierScheduler returns the scheduler of a priority tier, creating it on
+// first use. Callers must hold schedMu.
+func (p *weightedQueueProcessor) tierScheduler(tier int) Scheduler {
+	s, ok := p.tierSchedulers[tier]
+	if !ok {
+		s = p.newScheduler(SchedulerSettings{
+			Queues: p.view,
+			Config: p.config,
+		})
+		p.tierSchedulers[tier] = s
+	}
+	return s
+}
+
+func (p *weightedQueueProcessor) onEnqueue(source string, item queueItem) {
+	tier := p.domain.GetPriorityForTenant(source)
+	p.schedMu.Lock()
+	p.tierScheduler(tier).OnEnqueue(source, batchInfo(p.domain, item))
+	p.schedMu.Unlock()
+}
+
+// activeTierWeights restricts weights to the sources of the highest priority
+// tier that currently has queued data of a source with a positive weight.
+// Weights then only split traffic among tenants of the same tier.
+func (p *weightedQueueProcessor) activeTierWeights(weights map[string]float64) (int, map[string]float64) {
+	p.domain.Priorities.RLock()
+	defer p.domain.Priorities.RUnlock()
+
+	tierOf := func(source string) int {
+		if tier, ok := p.domain.Priorities.Tiers[source]; ok {
+			return tier
+		}
+		return weightupdateextension.DefaultPriority
+	}
+
+	top, found := 0, false
+	for source, w := range weights {
+		// Sources without weight are never scheduled, so their data must
+		// not keep the lower tiers waiting
+		if w <= 0 || p.view.Len(source) == 0 {
+			continue
+		}
+		if tier := tierOf(source); !found || tier > top {
+			top, found = tier, true
+		}
+	}
+	if !found {
+		return 0, nil
+	}
+
+	tierWeights := make(map[string]float64)
+	for source, w := range weights {
+		if tierOf(source) == top {
+			tierWeights[source] = w
+		}
+	}
+	return top, tierWeights
+}
+
+func (p *weightedQueueProcessor) snapshotWeights() map[string]float64 {
+	p.domain.Weights.RLock()
+	defer p.domain.Weights.RUnlock()
+	weights := make(map[string]float64, len(p.domain.Weights.Weights))
+	for k, v := range p.domain.Weights.Weights {
+		weights[k] = v
+	}
+	return weights
+}
+
+func (p *weightedQueueProcessor) recordThrottled(source string, d time.Duration) {
+	p.throttledCounter.Add(context.Background(), d.Seconds(), p.attrs(source))
+}
+
+// attrs returns the attributes of the weightedqueue_* telemetry for source
+func (p *weightedQueueProcessor) attrs(source string, extra ...attribute.KeyValue) metric.MeasurementOption {
+	return metric.WithAttributes(append([]attribute.KeyValue{
+		attribute.String("source", source),
+		attribute.String("signal", p.signal.name),
+	}, extra...)...)
+}
+
+// queueView exposes the per-source queues to schedulers. Rate limited
+// sources appear empty until their token bucket admits the head batch,
+// sources backing off after a failed forward until the backoff ends, and
+// sources at their in-flight limit until one of their forwards finishes.
+type queueView struct {
+	queues   *sync.Map // map[string]*dynamicQueue
+	limiter  *rateLimiter
+	retry    *retryTracker
+	inFlight *inFlightLimiter
+	domain   *weightupdateextension.Domain
+}
+
+// held reports whether source may not forward right now
+func (v queueView) held(source string) bool {
+	return v.limiter.isThrottled(source) || v.retry.isBackingOff(source) || v.inFlight.isFull(source)
+}
+
+func (v queueView) Len(source string) int {
+	if v.held(source) {
+		return 0
+	}
+	qIface, ok := v.queues.Load(source)
+	if !ok {
+		return 0
+	}
+	return qIface.(*dynamicQueue).len()
+}
+
+func (v queueView) Head(source string) (BatchInfo, bool) {
+	if v.held(source) {
+		return BatchInfo{}, false
+	}
+	qIface, ok := v.queues.Load(source)
+	if !ok {
+		return BatchInfo{}, false
+	}
+	item, ok := qIface.(*dynamicQueue).head()
+	if !ok {
+		return BatchInfo{}, false
+	}
+	return batchInfo(v.domain, item), true
+}
+
+func (v queueView) Held(source string) bool {
+	if !v.held(source) {
+		return false
+	}
+	qIface, ok := v.queues.Load(source)
+	return ok && qIface.(*dynamicQueue).len() > 0
+}
+
+func (v queueView) MeanCost(source string) float64 {
+	qIface, ok := v.queues.Load(source)
+	if !ok {
+		return 0
+	}
+	return qIface.(*dynamicQueue).meanCost()
 }
@@ -0,0 +1,134 @@
+package weightedqueueprocessor
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	weightupdateextension "github.com/alexandrosst/weightupdateextension"
+
+	"go.opentelemetry.io/collector/client"
+	"go.opentelemetry.io/collector/component"
+	"go.opentelemetry.io/collector/pdata/pmetric"
+	"go.opentelemetry.io/collector/processor"
+	"go.opentelemetry.io/otel/metric/noop"
+	"go.uber.org/zap"
+)
+
+type nopHost struct{}
+
+func (nopHost) GetExtensions() map[component.ID]component.Component { return nil }
+
+// newTestProcessor builds a metrics processor forwarding to consume
+func newTestProcessor(t *testing.T, cfg *Config, consume func(context.Context, telemetry) error) *weightedQueueProcessor {
+	t.Helper()
+	set := processor.Settings{TelemetrySettings: component.TelemetrySettings{
+		Logger:        zap.NewNop(),
+		MeterProvider: noop.NewMeterProvider(),
+	}}
+	p, err := newWeightedQueueProcessor(set, cfg, metricsSignal, consume)
+	if err != nil {
+		t.Fatalf("newWeightedQueueProcessor: %v", err)
+	}
+	return p
+}
+
+// startTestProcessor starts a metrics processor without a weightupdate
+// extension, forwarding to consume
+func startTestProcessor(t *testing.T, cfg *Config, consume func(context.Context, telemetry) error) *weightedQueueProcessor {
+	t.Helper()
+	p := newTestProcessor(t, cfg, consume)
+	if err := p.Start(context.Background(), nopHost{}); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	t.Cleanup(func() { p.Shutdown(context.Background()) })
+	return p
+}
+
+func sourceMetrics(source string) pmetric.Metrics {
+	md := pmetric.NewMetrics()
+	rm := md.ResourceMetrics().AppendEmpty()
+	rm.Resource().Attributes().PutStr("source.id", source)
+	rm.ScopeMetrics().AppendEmpty().Metrics().AppendEmpty().SetName(source)
+	return md
+}
+
+func TestZeroWeightTierDoesNotStarveLowerTiers(t *testing.T) {
+	cfg := createDefaultConfig().(*Config)
+	cfg.InitialWeights = map[string]float64{"hi": 0, "lo": 1}
+	cfg.Priorities = map[string]int{"hi": 1}
+	cfg.PollIntervalMs = 10
+
+	var forwarded atomic.Int64
+	p := startTestProcessor(t, cfg, func(context.Context, telemetry) error {
+		forwarded.Add(1)
+		return nil
+	})
+
+	if err := p.ConsumeMetrics(context.Background(), sourceMetrics("hi")); err != nil {
+		t.Fatalf("ConsumeMetrics: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := p.ConsumeMetrics(context.Background(), sourceMetrics("lo")); err != nil {
+			t.Fatalf("ConsumeMetrics: %v", err)
+		}
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for forwarded.Load() < 3 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := forwarded.Load(); n != 3 {
+		t.Fatalf("forwarded %d batches of the lower tier, want 3", n)
+	}
+}
+
+func TestEnqueueRejectsClosedQueue(t *testing.T) {
+	for _, policy := range []string{OverflowDropNewest, OverflowDropOldest, OverflowBlock} {
+		cfg := createDefaultConfig().(*Config)
+		cfg.Overflow.Policy = policy
+		cfg.Overflow.BlockTimeout = time.Second
+		p := startTestProcessor(t, cfg, func(context.Context, telemetry) error { return nil })
+
+		queue := p.queueFor("a")
+		queue.close()
+		item := p.newQueueItem(metricsBatch{sourceMetrics("a")}, "a", "a", client.Info{}, time.Now(), 0)
+		if _, err := p.enqueue(context.Background(), "a", queue, item); !errors.Is(err, errQueueClosed) {
+			t.Errorf("%s: enqueue into a closed queue returned %v, want errQueueClosed", policy, err)
+		}
+		if n := p.totalEnqueued.Load(); n != 0 {
+			t.Errorf("%s: %d batches counted after enqueue into a closed queue", policy, n)
+		}
+	}
+}
+
+func TestCoalescedBatchesCountAgainstMaxInFlight(t *testing.T) {
+	cfg := createDefaultConfig().(*Config)
+	cfg.Coalesce.MaxBatches = 3
+	cfg.MaxInFlight = 2
+	cfg.MaxTotalCapacity = 10
+	p := newTestProcessor(t, cfg, func(context.Context, telemetry) error { return nil })
+	// Set up like Start, without the workers
+	p.domain = weightupdateextension.NewDomain()
+	p.view = queueView{queues: &p.queues, limiter: p.limiter, retry: p.retry, inFlight: p.inFlight, domain: p.domain}
+
+	for i := 0; i < 5; i++ {
+		if err := p.ConsumeMetrics(context.Background(), sourceMetrics("a")); err != nil {
+			t.Fatalf("ConsumeMetrics: %v", err)
+		}
+	}
+
+	_, _, items, ok := p.nextBatch()
+	if !ok || len(items) != 2 {
+		t.Fatalf("first forward took %d batches, want 2", len(items))
+	}
+	if _, _, items, ok := p.nextBatch(); ok {
+		t.Fatalf("forward of %d batches beyond max_in_flight", len(items))
+	}
+	p.inFlight.release("a", len(items))
+	if _, _, items, ok := p.nextBatch(); !ok || len(items) != 2 {
+		t.Fatalf("forward after release took %d batches, want 2", len(items))
+	}
+}
@@ -0,0 +1,333 @@
+package weightedqueueprocessor
+
+import (
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/collector/client"
+	"go.uber.org/zap"
+)
+
+// queueItem is a queued batch together with its scheduling metadata
+type queueItem struct {
+	data       telemetry
+	source     string      // source of the queue holding the batch
+	origin     string      // source the batch was received from, see Config.Classes
+	info       client.Info // client of the request, restored when forwarding
+	cost       float64
+	enqueuedAt time.Time
+	initialTs  int64  // initial_timestamp in UnixNano, 0 if absent
+	count      int    // data points, spans or log records
+	bytes      int64  // OTLP proto size, measured at enqueue time
+	seq        uint64 // position in the source's WAL, 0 without persistence
+	attempts   int    // failed forwards so far
+}
+
+// dynamicQueue for resizable queues
+type dynamicQueue struct {
+	mu          sync.Mutex
+	items       []queueItem
+	cap         int
+	maxBytes    int64     // limit on queuedBytes, 0 if unlimited
+	queuedCost  float64   // sum of item costs currently queued
+	queuedBytes int64     // sum of item sizes currently queued
+	wal         *queueWAL // nil without persistence
+	closed      bool      // set by close and persist, rejects requeue
+	dequeuedAt  time.Time // last dequeue, see waitingSince
+	// inFlight holds the WAL add records of the dequeued items by seq, until
+	// the forward was acked or the items dropped. The records are encoded at
+	// dequeue, as the forwarded data then belongs to the next consumer.
+	// Only kept with persistence.
+	inFlight map[uint64][]byte
+}
+
+// enqueue appends item if it fits. It returns false without it if the queue
+// is full or closed.
+func (q *dynamicQueue) enqueue(item queueItem) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed || len(q.items) >= q.cap || (q.maxBytes > 0 && q.queuedBytes+item.bytes > q.maxBytes) {
+		return false
+	}
+	if q.wal != nil {
+		q.wal.add(&item)
+	}
+	q.push(item)
+	return true
+}
+
+// push appends item and accounts for it. Callers must hold mu.
+func (q *dynamicQueue) push(item queueItem) {
+	q.items = append(q.items, item)
+	q.queuedCost += item.cost
+	q.queuedBytes += item.bytes
+}
+
+// drop accounts for items that left the queue. Callers must hold mu.
+func (q *dynamicQueue) drop(items []queueItem) {
+	for _, item := range items {
+		q.queuedCost -= item.cost
+		q.queuedBytes -= item.bytes
+	}
+	if len(q.items) == 0 {
+		q.queuedCost = 0 // avoid float drift on an empty queue
+	}
+}
+
+func (q *dynamicQueue) dequeue() (queueItem, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.items) == 0 {
+		return queueItem{}, false
+	}
+	item := q.items[0]
+	q.items = q.items[1:]
+	q.dequeuedAt = time.Now()
+	q.drop([]queueItem{item})
+	if q.wal != nil {
+		// The batch stays in the WAL until ack, so a crash during the
+		// forward replays it
+		record, err := q.wal.appendAdd(nil, item)
+		if err != nil {
+			q.wal.logger.Error("Failed to encode in-flight batch, it is lost if the WAL is compacted", zap.String("path", q.wal.path), zap.Error(err))
+			return item, true
+		}
+		if q.inFlight == nil {
+			q.inFlight = make(map[uint64][]byte)
+		}
+		q.inFlight[item.seq] = record
+	}
+	return item, true
+}
+
+// ack removes dequeued items from the WAL once they were forwarded or
+// dropped
+func (q *dynamicQueue) ack(items ...queueItem) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.wal == nil {
+		return
+	}
+	for _, item := range items {
+		delete(q.inFlight, item.seq)
+	}
+	q.wal.remove(items...)
+	q.wal.maybeCompact(q.items, q.inFlight)
+}
+
+// requeue puts a batch whose forward failed back at the head of the queue.
+// The batch never stopped counting against the global capacity, so it is
+// accepted even if the queue filled up in the meantime. It returns false if
+// the queue was closed while the batch was in flight. The batch never left
+// the WAL, and its seq keeps it ahead of the queued batches on replay.
+func (q *dynamicQueue) requeue(item queueItem) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return false
+	}
+	delete(q.inFlight, item.seq)
+	q.items = append([]queueItem{item}, q.items...)
+	q.queuedCost += item.cost
+	q.queuedBytes += item.bytes
+	return true
+}
+
+// head returns the next batch to be dequeued without removing it
+func (q *dynamicQueue) head() (queueItem, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.items) == 0 {
+		return queueItem{}, false
+	}
+	return q.items[0], true
+}
+
+// waitingSince returns since when the queue waits to be served: the enqueue
+// time of its head batch, or its last dequeue if that is later, so a
+// backlog the source is being served from does not count as waiting
+func (q *dynamicQueue) waitingSince() (time.Time, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.items) == 0 {
+		return time.Time{}, false
+	}
+	if q.dequeuedAt.After(q.items[0].enqueuedAt) {
+		return q.dequeuedAt, true
+	}
+	return q.items[0].enqueuedAt, true
+}
+
+// meanCost returns the average cost of the queued batches
+func (q *dynamicQueue) meanCost() float64 {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.items) == 0 {
+		return 0
+	}
+	return q.queuedCost / float64(len(q.items))
+}
+
+// isClosed reports whether close or persist was called
+func (q *dynamicQueue) isClosed() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.closed
+}
+
+func (q *dynamicQueue) len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.items)
+}
+
+// size returns the bytes currently queued
+func (q *dynamicQueue) size() int64 {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.queuedBytes
+}
+
+// enqueueEvicting appends item, evicting the oldest items as needed to stay
+// within the queue's batch and byte limits. At least globalBatches items and
+// globalBytes bytes are evicted on top of that, so the global totals stay
+// within their limits. It returns the evicted items and whether item was
+// queued; when it was not, or the queue is closed, nothing is evicted.
+func (q *dynamicQueue) enqueueEvicting(item queueItem, globalBatches int, globalBytes int64) ([]queueItem, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed || q.cap <= 0 || (q.maxBytes > 0 && item.bytes > q.maxBytes) {
+		return nil, false
+	}
+
+	n := 0
+	var evictedBytes int64
+	for n < len(q.items) {
+		fits := len(q.items)-n < q.cap &&
+			(q.maxBytes == 0 || q.queuedBytes-evictedBytes+item.bytes <= q.maxBytes) &&
+			n >= globalBatches && evictedBytes >= globalBytes
+		if fits {
+			break
+		}
+		evictedBytes += q.items[n].bytes
+		n++
+	}
+	if n < globalBatches || evictedBytes < globalBytes {
+		return nil, false
+	}
+
+	evicted := append([]queueItem(nil), q.items[:n]...)
+	q.items = q.items[n:]
+	q.drop(evicted)
+	if q.wal != nil {
+		q.wal.remove(evicted...)
+		q.wal.add(&item)
+	}
+	q.push(item)
+	return evicted, true
+}
+
+// setCap resizes the queue and returns the trimmed items. The newest items
+// are trimmed, or the oldest with trimOldest.
+func (q *dynamicQueue) setCap(newCap int, trimOldest bool) []queueItem {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.cap = newCap
+	excess := len(q.items) - q.cap
+	if excess <= 0 {
+		return nil
+	}
+	var trimmed []queueItem
+	if trimOldest {
+		trimmed = append(trimmed, q.items[:excess]...)
+		q.items = q.items[excess:]
+	} else {
+		trimmed = append(trimmed, q.items[q.cap:]...)
+		q.items = q.items[:q.cap] // Trim excess
+	}
+	q.drop(trimmed)
+	if q.wal != nil {
+		q.wal.remove(trimmed...)
+	}
+	return trimmed
+}
+
+// shed removes the items for which expired reports true and returns them.
+// With headOnly it stops at the first item that has not expired.
+func (q *dynamicQueue) shed(expired func(queueItem) bool, headOnly bool) []queueItem {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var shed []queueItem
+	kept := q.items[:0]
+	for i, item := range q.items {
+		if !expired(item) {
+			if headOnly {
+				kept = append(kept, q.items[i:]...)
+				break
+			}
+			kept = append(kept, item)
+			continue
+		}
+		shed = append(shed, item)
+	}
+	if len(shed) == 0 {
+		return nil
+	}
+	clear(q.items[len(kept):])
+	q.items = kept
+	q.drop(shed)
+	if q.wal != nil {
+		q.wal.remove(shed...)
+		q.wal.maybeCompact(q.items, q.inFlight)
+	}
+	return shed
+}
+
+// restore loads items replayed from the WAL, ahead of anything queued since
+func (q *dynamicQueue) restore(wal *queueWAL, items []queueItem) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.wal = wal
+	q.items = append(items, q.items...)
+	for _, item := range items {
+		q.queuedCost += item.cost
+		q.queuedBytes += item.bytes
+	}
+}
+
+// close discards all items, deletes the WAL and returns the discarded items
+func (q *dynamicQueue) close() []queueItem {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	discarded := q.items
+	q.items = nil
+	q.queuedCost = 0
+	q.queuedBytes = 0
+	q.closed = true
+	q.inFlight = nil
+	if q.wal != nil {
+		if err := q.wal.delete(); err != nil {
+			q.wal.logger.Warn("Failed to delete queue WAL", zap.String("path", q.wal.path), zap.Error(err))
+		}
+		q.wal = nil
+	}
+	return discarded
+}
+
+// persist closes the WAL, keeping the queued items on disk for the next
+// start, and releases them from memory. It returns how many were kept.
+func (q *dynamicQueue) persist() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	n := len(q.items)
+	q.items = nil
+	q.queuedCost = 0
+	q.queuedBytes = 0
+	q.closed = true
+	q.inFlight = nil
+	if q.wal != nil {
+		q.wal.close()
+		q.wal = nil
+	}
+	return n
+}
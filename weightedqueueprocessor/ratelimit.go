@@ -0,0 +1,147 @@
+package weightedqueueprocessor
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	weightupdateextension "github.com/alexandrosst/weightupdateextension"
+)
+
+// tokenBucket is the rate limit state of one source
+type tokenBucket struct {
+	limit          weightupdateextension.RateLimit
+	tokens         float64
+	last           time.Time // last refill
+	throttledSince time.Time // start of the unreported throttled period, zero if not throttled
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	b.tokens = math.Min(b.limit.Burst, b.tokens+now.Sub(b.last).Seconds()*b.limit.Rate)
+	b.last = now
+}
+
+// cost returns what forwarding item takes from the bucket
+func (b *tokenBucket) cost(item queueItem) float64 {
+	if b.limit.Unit == weightupdateextension.RateUnitDataPoints {
+		return float64(item.count)
+	}
+	return 1
+}
+
+// need returns the tokens required before item may be forwarded. Items
+// larger than the burst wait for a full bucket and leave it in debt.
+func (b *tokenBucket) need(item queueItem) float64 {
+	return math.Min(b.cost(item), b.limit.Burst)
+}
+
+// rateLimiter enforces per-source token buckets in the dequeue path. refresh
+// decides once per scheduling decision which sources are throttled; the
+// queue view then hides those sources from the schedulers.
+type rateLimiter struct {
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	throttled map[string]bool
+	release   time.Duration // until the earliest throttled source may forward again
+}
+
+func newRateLimiter() *rateLimiter {
+	return &rateLimiter{
+		buckets:   make(map[string]*tokenBucket),
+		throttled: make(map[string]bool),
+	}
+}
+
+// refresh syncs the buckets with the shared limits, refills them and marks
+// sources whose head batch does not fit. onThrottled receives the throttled
+// time accumulated per source since the previous refresh.
+func (l *rateLimiter) refresh(shared *weightupdateextension.SharedRateLimits, queues *sync.Map, onThrottled func(source string, d time.Duration)) {
+	shared.RLock()
+	limits := make(map[string]weightupdateextension.RateLimit, len(shared.Limits))
+	for source, limit := range shared.Limits {
+		limits[source] = limit
+	}
+	shared.RUnlock()
+
+	now := time.Now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for source, b := range l.buckets {
+		if _, ok := limits[source]; !ok {
+			if !b.throttledSince.IsZero() {
+				onThrottled(source, now.Sub(b.throttledSince))
+			}
+			delete(l.buckets, source)
+		}
+	}
+	clear(l.throttled)
+	l.release = 0
+
+	for source, limit := range limits {
+		b, ok := l.buckets[source]
+		if !ok {
+			b = &tokenBucket{limit: limit, tokens: limit.Burst, last: now}
+			l.buckets[source] = b
+		}
+		b.limit = limit
+		b.refill(now)
+
+		var head queueItem
+		hasHead := false
+		if qIface, ok := queues.Load(source); ok {
+			head, hasHead = qIface.(*dynamicQueue).head()
+		}
+
+		if !hasHead || b.tokens >= b.need(head) {
+			if !b.throttledSince.IsZero() {
+				onThrottled(source, now.Sub(b.throttledSince))
+				b.throttledSince = time.Time{}
+			}
+			continue
+		}
+
+		l.throttled[source] = true
+		if !b.throttledSince.IsZero() {
+			onThrottled(source, now.Sub(b.throttledSince))
+		}
+		b.throttledSince = now
+
+		wait := time.Duration((b.need(head) - b.tokens) / b.limit.Rate * float64(time.Second))
+		if l.release == 0 || wait < l.release {
+			l.release = wait
+		}
+	}
+}
+
+func (l *rateLimiter) isThrottled(source string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.throttled[source]
+}
+
+// take charges a dequeued item to its source's bucket
+func (l *rateLimiter) take(source string, item queueItem) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if b, ok := l.buckets[source]; ok {
+		b.tokens -= b.cost(item)
+	}
+}
+
+// fits reports whether the bucket of source still holds the tokens for item
+func (l *rateLimiter) fits(source string, item queueItem) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	b, ok := l.buckets[source]
+	return !ok || b.tokens >= b.cost(item)
+}
+
+// nextRelease returns how long until a throttled source may forward again,
+// or 0 if no source is throttled
+func (l *rateLimiter) nextRelease() time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.release
+}
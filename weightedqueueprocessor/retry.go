@@ -0,0 +1,109 @@
+package weightedqueueprocessor
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	weightupdateextension "github.com/alexandrosst/weightupdateextension"
+)
+
+// retryState is the retry bookkeeping of one source
+type retryState struct {
+	failures int          // consecutive failed forwards
+	until    time.Time    // end of the current backoff
+	budget   *tokenBucket // retries the source may still spend, nil if unlimited
+}
+
+// retryTracker applies exponential backoff to sources whose forwards fail
+// with a retryable error. While a source backs off, the queue view hides it
+// from the schedulers, exactly like a rate limited source.
+type retryTracker struct {
+	mu     sync.Mutex
+	config RetryConfig
+	states map[string]*retryState
+}
+
+func newRetryTracker(config RetryConfig) *retryTracker {
+	return &retryTracker{config: config, states: make(map[string]*retryState)}
+}
+
+// budgetFor returns the retries per second allowed to source
+func (r *retryTracker) budgetFor(source string) float64 {
+	if budget, ok := r.config.Sources[source]; ok {
+		return budget
+	}
+	return r.config.Budget
+}
+
+// failed records a retryable failure of source. It reports whether the
+// source's retry budget admits another attempt and, if so, how long the
+// source backs off before it.
+func (r *retryTracker) failed(source string) (time.Duration, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	s, ok := r.states[source]
+	if !ok {
+		s = &retryState{}
+		if budget := r.budgetFor(source); budget > 0 {
+			limit := weightupdateextension.RateLimit{Rate: budget, Burst: math.Max(budget, 1)}
+			s.budget = &tokenBucket{limit: limit, tokens: limit.Burst, last: now}
+		}
+		r.states[source] = s
+	}
+
+	if s.budget != nil {
+		s.budget.refill(now)
+		if s.budget.tokens < 1 {
+			return 0, false
+		}
+		s.budget.tokens--
+	}
+
+	s.failures++
+	delay := float64(r.config.InitialInterval) * math.Pow(r.config.Multiplier, float64(s.failures-1))
+	backoff := time.Duration(math.Min(delay, float64(r.config.MaxInterval)))
+	s.until = now.Add(backoff)
+	return backoff, true
+}
+
+// succeeded ends the backoff of source after a successful forward
+func (r *retryTracker) succeeded(source string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if s, ok := r.states[source]; ok {
+		s.failures = 0
+		s.until = time.Time{}
+	}
+}
+
+// forget drops the state of a deleted source
+func (r *retryTracker) forget(source string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.states, source)
+}
+
+func (r *retryTracker) isBackingOff(source string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s, ok := r.states[source]
+	return ok && time.Now().Before(s.until)
+}
+
+// nextRelease returns how long until the earliest backing off source may
+// forward again, or 0 if no source backs off
+func (r *retryTracker) nextRelease() time.Duration {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var release time.Duration
+	now := time.Now()
+	for _, s := range r.states {
+		if wait := s.until.Sub(now); wait > 0 && (release == 0 || wait < release) {
+			release = wait
+		}
+	}
+	return release
+}
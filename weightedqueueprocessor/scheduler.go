@@ -0,0 +1,209 @@
+package weightedqueueprocessor
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+// BatchInfo describes a queued batch to a Scheduler.
+type BatchInfo struct {
+	Cost       float64   // in the configured cost_unit
+	EnqueuedAt time.Time // when the batch entered the processor
+	// Deadline is when the batch misses its tenant's freshness SLO: its
+	// initial_timestamp (or EnqueuedAt when absent) plus the SLO threshold.
+	Deadline time.Time
+}
+
+// QueueView gives a Scheduler read access to the per-source queues.
+type QueueView interface {
+	// Len returns the number of batches queued for source.
+	Len(source string) int
+	// Head describes the next batch of source, if it has one.
+	Head(source string) (BatchInfo, bool)
+	// MeanCost returns the average cost of the batches queued for source.
+	MeanCost(source string) float64
+	// Held reports whether source has queued batches that Len and Head hide
+	// because it may not forward now: it is rate limited, backing off after
+	// a failed forward or at its in-flight limit.
+	Held(source string) bool
+}
+
+// Scheduler decides which source forwards the next batch. The processor
+// keeps one Scheduler per priority tier and serializes all calls to it, so
+// implementations do not need their own locking.
+type Scheduler interface {
+	// OnEnqueue is called after a batch was queued for source.
+	OnEnqueue(source string, batch BatchInfo)
+	// OnWeightsChanged is called with the weights of every source in the
+	// scheduler's tier whenever they change, and before the first Next.
+	// The scheduler may keep the map.
+	OnWeightsChanged(weights map[string]float64)
+	// Next returns the source whose head batch is forwarded next, or "" if
+	// no source should forward now. The processor dequeues exactly one batch
+	// from the returned source, plus any batches it coalesces with it.
+	Next() (source string)
+}
+
+// CoalescingScheduler is optionally implemented by schedulers that account
+// for every forwarded batch. With coalescing, the processor asks Coalesce
+// before merging each further batch of the source Next returned into the
+// same forward; returning false stops merging. Schedulers without it let
+// the processor merge up to the configured limits. The head batch of a
+// source served without asking Next, such as one overdue under
+// Config.Aging, is passed to Coalesce too, and served whatever it returns.
+type CoalescingScheduler interface {
+	Coalesce(source string, batch BatchInfo) bool
+}
+
+// SchedulerSettings is passed to a SchedulerFactory.
+type SchedulerSettings struct {
+	Queues QueueView
+	Config *Config // processor configuration, read-only
+}
+
+// SchedulerFactory creates a Scheduler for one priority tier.
+type SchedulerFactory func(set SchedulerSettings) Scheduler
+
+var (
+	schedulersMu sync.RWMutex
+	schedulers   = map[string]SchedulerFactory{
+		SchedulerWeightedRandom: newWeightedRandomScheduler,
+		SchedulerRoundRobin:     newRoundRobinScheduler,
+		SchedulerDRR:            newDRRScheduler,
+		SchedulerEDF:            newEDFScheduler,
+	}
+)
+
+// RegisterScheduler makes a scheduler selectable by name through
+// Config.Scheduler. Distributions built with OCB can call it from an init
+// function of any package compiled into the collector.
+func RegisterScheduler(name string, factory SchedulerFactory) error {
+	if name == "" {
+		return errors.New("scheduler name is required")
+	}
+	if factory == nil {
+		return errors.New("scheduler factory is required")
+	}
+	schedulersMu.Lock()
+	defer schedulersMu.Unlock()
+	if _, exists := schedulers[name]; exists {
+		return fmt.Errorf("scheduler %q is already registered", name)
+	}
+	schedulers[name] = factory
+	return nil
+}
+
+func lookupScheduler(name string) (SchedulerFactory, bool) {
+	schedulersMu.RLock()
+	defer schedulersMu.RUnlock()
+	factory, ok := schedulers[name]
+	return factory, ok
+}
+
+func registeredSchedulers() []string {
+	schedulersMu.RLock()
+	defer schedulersMu.RUnlock()
+	names := make([]string, 0, len(schedulers))
+	for name := range schedulers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// weightedRandomScheduler draws a non-empty queue with probability
+// proportional to its weight divided by the mean cost of its queued batches,
+// so each source's share of forwarded cost converges to its weight. With the
+// batches cost unit every batch costs 1 and this is a plain weighted draw.
+type weightedRandomScheduler struct {
+	queues  QueueView
+	weights map[string]float64
+}
+
+func newWeightedRandomScheduler(set SchedulerSettings) Scheduler {
+	return &weightedRandomScheduler{queues: set.Queues}
+}
+
+func (s *weightedRandomScheduler) OnEnqueue(string, BatchInfo) {}
+
+func (s *weightedRandomScheduler) OnWeightsChanged(weights map[string]float64) {
+	s.weights = weights
+}
+
+func (s *weightedRandomScheduler) Next() string {
+	candidates := make([]string, 0, len(s.weights))
+	adjusted := make([]float64, 0, len(s.weights))
+	var total float64
+	for source, w := range s.weights {
+		if w <= 0 || s.queues.Len(source) == 0 {
+			continue
+		}
+		mean := s.queues.MeanCost(source)
+		if mean <= 0 {
+			mean = 1 // batches without data points still get drawn
+		}
+		candidates = append(candidates, source)
+		adjusted = append(adjusted, w/mean)
+		total += w / mean
+	}
+	if len(candidates) == 0 {
+		return ""
+	}
+	r := rand.Float64() * total
+
+	var acc float64
+	for i, source := range candidates {
+		acc += adjusted[i]
+		if r < acc {
+			return source
+		}
+	}
+	return candidates[len(candidates)-1]
+}
+
+// roundRobinScheduler serves non-empty queues of positively weighted sources
+// one batch at a time in a fixed (sorted) order, ignoring weight magnitudes.
+type roundRobinScheduler struct {
+	queues QueueView
+	ring   []string
+	pos    int
+}
+
+func newRoundRobinScheduler(set SchedulerSettings) Scheduler {
+	return &roundRobinScheduler{queues: set.Queues}
+}
+
+func (s *roundRobinScheduler) OnEnqueue(string, BatchInfo) {}
+
+func (s *roundRobinScheduler) OnWeightsChanged(weights map[string]float64) {
+	current := ""
+	if s.pos < len(s.ring) {
+		current = s.ring[s.pos]
+	}
+	s.ring = s.ring[:0]
+	for source, w := range weights {
+		if w > 0 {
+			s.ring = append(s.ring, source)
+		}
+	}
+	sort.Strings(s.ring)
+	s.pos = sort.SearchStrings(s.ring, current)
+}
+
+func (s *roundRobinScheduler) Next() string {
+	for range s.ring {
+		if s.pos >= len(s.ring) {
+			s.pos = 0
+		}
+		source := s.ring[s.pos]
+		s.pos++
+		if s.queues.Len(source) > 0 {
+			return source
+		}
+	}
+	return ""
+}
@@ -0,0 +1,231 @@
+package weightedqueueprocessor
+
+import (
+	"go.opentelemetry.io/collector/pdata/pcommon"
+	"go.opentelemetry.io/collector/pdata/plog"
+	"go.opentelemetry.io/collector/pdata/pmetric"
+	"go.opentelemetry.io/collector/pdata/ptrace"
+)
+
+// Values of the signal attribute on the weightedqueue_* telemetry.
+const (
+	signalMetrics = "metrics"
+	signalTraces  = "traces"
+	signalLogs    = "logs"
+)
+
+// telemetry is a queued single-resource batch of one signal
+type telemetry interface {
+	// count returns the data points, spans or log records in the batch
+	count() int
+	// cost measures the batch in costUnit, one of the units of its signal
+	cost(costUnit string) float64
+	// size returns the OTLP proto size of the batch in bytes
+	size() int
+	// initialTimestamp returns the initial_timestamp set by an upstream
+	// collector in UnixNano, or 0 if absent
+	initialTimestamp() int64
+	// marshal encodes the batch as OTLP protobuf for the WAL
+	marshal() ([]byte, error)
+}
+
+// signalKind describes how the processor handles one signal
+type signalKind struct {
+	name      string
+	costUnits []string // supported values of Config.CostUnit
+	unmarshal func([]byte) (telemetry, error)
+	// merge copies the resources of batches, in order, into one batch
+	merge func(batches []telemetry) telemetry
+}
+
+var (
+	metricsSignal = signalKind{
+		name:      signalMetrics,
+		costUnits: []string{CostBatches, CostDataPoints, CostBytes},
+		unmarshal: func(buf []byte) (telemetry, error) {
+			var u pmetric.ProtoUnmarshaler
+			md, err := u.UnmarshalMetrics(buf)
+			return metricsBatch{md}, err
+		},
+		merge: func(batches []telemetry) telemetry {
+			md := pmetric.NewMetrics()
+			for _, b := range batches {
+				rms := b.(metricsBatch).md.ResourceMetrics()
+				for i := 0; i < rms.Len(); i++ {
+					rms.At(i).CopyTo(md.ResourceMetrics().AppendEmpty())
+				}
+			}
+			return metricsBatch{md}
+		},
+	}
+	tracesSignal = signalKind{
+		name:      signalTraces,
+		costUnits: []string{CostBatches, CostSpans, CostBytes},
+		unmarshal: func(buf []byte) (telemetry, error) {
+			var u ptrace.ProtoUnmarshaler
+			td, err := u.UnmarshalTraces(buf)
+			return tracesBatch{td}, err
+		},
+		merge: func(batches []telemetry) telemetry {
+			td := ptrace.NewTraces()
+			for _, b := range batches {
+				rss := b.(tracesBatch).td.ResourceSpans()
+				for i := 0; i < rss.Len(); i++ {
+					rss.At(i).CopyTo(td.ResourceSpans().AppendEmpty())
+				}
+			}
+			return tracesBatch{td}
+		},
+	}
+	logsSignal = signalKind{
+		name:      signalLogs,
+		costUnits: []string{CostBatches, CostLogRecords, CostBodyBytes, CostBytes},
+		unmarshal: func(buf []byte) (telemetry, error) {
+			var u plog.ProtoUnmarshaler
+			ld, err := u.UnmarshalLogs(buf)
+			return logsBatch{ld}, err
+		},
+		merge: func(batches []telemetry) telemetry {
+			ld := plog.NewLogs()
+			for _, b := range batches {
+				rls := b.(logsBatch).ld.ResourceLogs()
+				for i := 0; i < rls.Len(); i++ {
+					rls.At(i).CopyTo(ld.ResourceLogs().AppendEmpty())
+				}
+			}
+			return logsBatch{ld}
+		},
+	}
+)
+
+type metricsBatch struct {
+	md pmetric.Metrics
+}
+
+func (b metricsBatch) count() int {
+	return b.md.DataPointCount()
+}
+
+func (b metricsBatch) cost(costUnit string) float64 {
+	switch costUnit {
+	case CostDataPoints:
+		return float64(b.md.DataPointCount())
+	case CostBytes:
+		return float64(b.size())
+	default:
+		return 1
+	}
+}
+
+// initialTimestamp returns the initial_timestamp data point attribute, as
+// read by the freshness exporter.
+func (b metricsBatch) initialTimestamp() int64 {
+	return initialTimestamp(b.md)
+}
+
+func (b metricsBatch) size() int {
+	var sizer pmetric.ProtoMarshaler
+	return sizer.MetricsSize(b.md)
+}
+
+func (b metricsBatch) marshal() ([]byte, error) {
+	var m pmetric.ProtoMarshaler
+	return m.MarshalMetrics(b.md)
+}
+
+type tracesBatch struct {
+	td ptrace.Traces
+}
+
+func (b tracesBatch) count() int {
+	return b.td.SpanCount()
+}
+
+func (b tracesBatch) cost(costUnit string) float64 {
+	switch costUnit {
+	case CostSpans:
+		return float64(b.td.SpanCount())
+	case CostBytes:
+		return float64(b.size())
+	default:
+		return 1
+	}
+}
+
+// initialTimestamp is not tracked for spans; deadlines of trace batches
+// start when they are enqueued.
+func (b tracesBatch) initialTimestamp() int64 {
+	return 0
+}
+
+func (b tracesBatch) size() int {
+	var sizer ptrace.ProtoMarshaler
+	return sizer.TracesSize(b.td)
+}
+
+func (b tracesBatch) marshal() ([]byte, error) {
+	var m ptrace.ProtoMarshaler
+	return m.MarshalTraces(b.td)
+}
+
+type logsBatch struct {
+	ld plog.Logs
+}
+
+func (b logsBatch) count() int {
+	return b.ld.LogRecordCount()
+}
+
+func (b logsBatch) cost(costUnit string) float64 {
+	switch costUnit {
+	case CostLogRecords:
+		return float64(b.ld.LogRecordCount())
+	case CostBodyBytes:
+		return float64(bodyBytes(b.ld))
+	case CostBytes:
+		return float64(b.size())
+	default:
+		return 1
+	}
+}
+
+// initialTimestamp is not tracked for log records; deadlines of log batches
+// start when they are enqueued.
+func (b logsBatch) initialTimestamp() int64 {
+	return 0
+}
+
+func (b logsBatch) size() int {
+	var sizer plog.ProtoMarshaler
+	return sizer.LogsSize(b.ld)
+}
+
+func (b logsBatch) marshal() ([]byte, error) {
+	var m plog.ProtoMarshaler
+	return m.MarshalLogs(b.ld)
+}
+
+// bodyBytes sums the length of the log record bodies. String and bytes
+// bodies count their raw length, structured bodies their JSON encoding.
+func bodyBytes(ld plog.Logs) int {
+	n := 0
+	rls := ld.ResourceLogs()
+	for i := 0; i < rls.Len(); i++ {
+		sls := rls.At(i).ScopeLogs()
+		for j := 0; j < sls.Len(); j++ {
+			lrs := sls.At(j).LogRecords()
+			for k := 0; k < lrs.Len(); k++ {
+				switch body := lrs.At(k).Body(); body.Type() {
+				case pcommon.ValueTypeEmpty:
+				case pcommon.ValueTypeStr:
+					n += len(body.Str())
+				case pcommon.ValueTypeBytes:
+					n += body.Bytes().Len()
+				default:
+					n += len(body.AsString())
+				}
+			}
+		}
+	}
+	return n
+}
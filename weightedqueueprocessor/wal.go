@@ -0,0 +1,337 @@
+package weightedqueueprocessor
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/collector/client"
+	"go.uber.org/zap"
+)
+
+// WAL record layout (little endian):
+//
+//	add:    op(1) seq(8) enqueuedAtUnixNano(8) originLen(4) origin metadataLen(4) metadata payloadLen(4) payload(OTLP proto of the signal)
+//	remove: op(1) seq(8)
+//
+// Replaying the records in order yields the queued items; sorting them by
+// seq restores the per-source queue order. A batch is removed once it was
+// forwarded or dropped, not when it is dequeued, so batches in flight
+// during a crash are replayed. metadata holds the kept request
+// metadata of the batch, see appendMetadata; the client address and auth
+// data are not persisted.
+const (
+	walOpAdd    byte = 1
+	walOpRemove byte = 2
+
+	walExt = ".wal"
+
+	// walCompactMinDead is the number of obsolete records that must
+	// accumulate before the file is rewritten with only the queued items.
+	walCompactMinDead = 256
+)
+
+// queueWAL is the write-ahead log of one source queue. It is only used
+// while holding the owning dynamicQueue's lock.
+type queueWAL struct {
+	path      string
+	f         *os.File
+	logger    *zap.Logger
+	unmarshal func([]byte) (telemetry, error)
+	live      int // add records not yet removed
+	dead      int // add and remove records that cancel each other out
+	nextSeq   uint64
+	fsync     bool // sync the file after every add record
+	buf       []byte
+}
+
+func walPath(dir, source string) string {
+	return filepath.Join(dir, url.PathEscape(source)+walExt)
+}
+
+// openWAL opens (or creates) the WAL of source and replays it. It returns
+// the queued items in queue order, decoding batches with unmarshal. With
+// fsync, every add record is synced to disk before the batch is queued.
+func openWAL(dir, source string, logger *zap.Logger, unmarshal func([]byte) (telemetry, error), fsync bool) (*queueWAL, []queueItem, error) {
+	path := walPath(dir, source)
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, nil, err
+	}
+	w := &queueWAL{path: path, f: f, logger: logger, unmarshal: unmarshal, fsync: fsync}
+
+	items, valid, err := w.replay()
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	// Drop a record torn by a crash in the middle of a write
+	if err := f.Truncate(valid); err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	if _, err := f.Seek(valid, io.SeekStart); err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	return w, items, nil
+}
+
+func (w *queueWAL) replay() ([]queueItem, int64, error) {
+	if _, err := w.f.Seek(0, io.SeekStart); err != nil {
+		return nil, 0, err
+	}
+	r := bufio.NewReader(w.f)
+	items := make(map[uint64]queueItem)
+	var valid int64
+
+	for {
+		var hdr [9]byte
+		if _, err := io.ReadFull(r, hdr[:]); err != nil {
+			break
+		}
+		seq := binary.LittleEndian.Uint64(hdr[1:])
+		size := int64(len(hdr))
+
+		switch hdr[0] {
+		case walOpAdd:
+			var meta [12]byte
+			if _, err := io.ReadFull(r, meta[:]); err != nil {
+				return sortedItems(items), valid, nil
+			}
+			origin := make([]byte, binary.LittleEndian.Uint32(meta[8:]))
+			if _, err := io.ReadFull(r, origin); err != nil {
+				return sortedItems(items), valid, nil
+			}
+			var metadataLen [4]byte
+			if _, err := io.ReadFull(r, metadataLen[:]); err != nil {
+				return sortedItems(items), valid, nil
+			}
+			metadata := make([]byte, binary.LittleEndian.Uint32(metadataLen[:]))
+			if _, err := io.ReadFull(r, metadata); err != nil {
+				return sortedItems(items), valid, nil
+			}
+			var payloadLen [4]byte
+			if _, err := io.ReadFull(r, payloadLen[:]); err != nil {
+				return sortedItems(items), valid, nil
+			}
+			payload := make([]byte, binary.LittleEndian.Uint32(payloadLen[:]))
+			if _, err := io.ReadFull(r, payload); err != nil {
+				return sortedItems(items), valid, nil
+			}
+			data, err := w.unmarshal(payload)
+			if err != nil {
+				return nil, 0, fmt.Errorf("corrupt WAL record %d in %s: %w", seq, w.path, err)
+			}
+			md, err := parseMetadata(metadata)
+			if err != nil {
+				return nil, 0, fmt.Errorf("corrupt WAL record %d in %s: %w", seq, w.path, err)
+			}
+			items[seq] = queueItem{
+				data:       data,
+				origin:     string(origin),
+				info:       client.Info{Metadata: md},
+				seq:        seq,
+				enqueuedAt: time.Unix(0, int64(binary.LittleEndian.Uint64(meta[:8]))),
+			}
+			w.live++
+			size += int64(len(meta) + len(origin) + len(metadataLen) + len(metadata) + len(payloadLen) + len(payload))
+		case walOpRemove:
+			if _, ok := items[seq]; ok {
+				delete(items, seq)
+				w.live--
+				w.dead += 2
+			}
+		default:
+			return sortedItems(items), valid, nil
+		}
+
+		valid += size
+		if seq >= w.nextSeq {
+			w.nextSeq = seq + 1
+		}
+	}
+	return sortedItems(items), valid, nil
+}
+
+func sortedItems(items map[uint64]queueItem) []queueItem {
+	sorted := make([]queueItem, 0, len(items))
+	for _, item := range items {
+		sorted = append(sorted, item)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].seq < sorted[j].seq })
+	return sorted
+}
+
+// add appends an add record for item. Items without a seq get the next one.
+func (w *queueWAL) add(item *queueItem) {
+	if item.seq == 0 {
+		w.nextSeq = max(w.nextSeq, 1)
+		item.seq = w.nextSeq
+		w.nextSeq++
+	}
+	if err := w.writeAdd(w.f, *item); err != nil {
+		w.logger.Error("Failed to append to queue WAL", zap.String("path", w.path), zap.Error(err))
+		return
+	}
+	w.live++
+	if w.fsync {
+		if err := w.f.Sync(); err != nil {
+			w.logger.Error("Failed to sync queue WAL", zap.String("path", w.path), zap.Error(err))
+		}
+	}
+}
+
+func (w *queueWAL) writeAdd(dst io.Writer, item queueItem) error {
+	var err error
+	w.buf, err = w.appendAdd(w.buf[:0], item)
+	if err != nil {
+		return err
+	}
+	_, err = dst.Write(w.buf)
+	return err
+}
+
+// appendAdd appends the add record of item to buf
+func (w *queueWAL) appendAdd(buf []byte, item queueItem) ([]byte, error) {
+	payload, err := item.data.marshal()
+	if err != nil {
+		return buf, err
+	}
+	buf = append(buf, walOpAdd)
+	buf = binary.LittleEndian.AppendUint64(buf, item.seq)
+	buf = binary.LittleEndian.AppendUint64(buf, uint64(item.enqueuedAt.UnixNano()))
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(len(item.origin)))
+	buf = append(buf, item.origin...)
+	lenAt := len(buf)
+	buf = binary.LittleEndian.AppendUint32(buf, 0)
+	buf = appendMetadata(buf, item.info.Metadata)
+	binary.LittleEndian.PutUint32(buf[lenAt:], uint32(len(buf)-lenAt-4))
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(len(payload)))
+	buf = append(buf, payload...)
+	return buf, nil
+}
+
+// remove appends remove records for items that left the queue
+func (w *queueWAL) remove(items ...queueItem) {
+	if len(items) == 0 {
+		return
+	}
+	w.buf = w.buf[:0]
+	for _, item := range items {
+		w.buf = append(w.buf, walOpRemove)
+		w.buf = binary.LittleEndian.AppendUint64(w.buf, item.seq)
+	}
+	if _, err := w.f.Write(w.buf); err != nil {
+		w.logger.Error("Failed to append to queue WAL", zap.String("path", w.path), zap.Error(err))
+		return
+	}
+	w.live -= len(items)
+	w.dead += 2 * len(items)
+}
+
+// maybeCompact rewrites the file with only the queued items and the add
+// records of the in-flight ones once obsolete records dominate it. An empty
+// queue with nothing in flight simply truncates the file.
+func (w *queueWAL) maybeCompact(items []queueItem, inFlight map[uint64][]byte) {
+	if w.dead < walCompactMinDead || w.dead < w.live {
+		return
+	}
+	if err := w.compact(items, inFlight); err != nil {
+		w.logger.Error("Failed to compact queue WAL", zap.String("path", w.path), zap.Error(err))
+	}
+}
+
+func (w *queueWAL) compact(items []queueItem, inFlight map[uint64][]byte) error {
+	if len(items) == 0 && len(inFlight) == 0 {
+		if err := w.f.Truncate(0); err != nil {
+			return err
+		}
+		if _, err := w.f.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		w.live, w.dead = 0, 0
+		return nil
+	}
+
+	tmpPath := w.path + ".tmp"
+	tmp, err := os.OpenFile(tmpPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	// Replay orders the items by seq, so the records may come in any order
+	bw := bufio.NewWriter(tmp)
+	for _, item := range items {
+		if err = w.writeAdd(bw, item); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		for _, record := range inFlight {
+			if _, err = bw.Write(record); err != nil {
+				break
+			}
+		}
+	}
+	if err == nil {
+		err = bw.Flush()
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, w.path)
+	}
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+
+	w.f.Close()
+	w.f = tmp
+	w.live, w.dead = len(items)+len(inFlight), 0
+	return nil
+}
+
+func (w *queueWAL) close() error {
+	return w.f.Close()
+}
+
+// delete closes and removes the WAL of a source that no longer exists
+func (w *queueWAL) delete() error {
+	w.f.Close()
+	return os.Remove(w.path)
+}
+
+// persistedSources lists the sources that have a WAL in dir
+func persistedSources(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var sources []string
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !strings.HasSuffix(name, walExt) {
+			continue
+		}
+		source, err := url.PathUnescape(strings.TrimSuffix(name, walExt))
+		if err != nil {
+			continue
+		}
+		sources = append(sources, source)
+	}
+	return sources, nil
+}
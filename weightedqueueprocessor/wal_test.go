@@ -0,0 +1,193 @@
+package weightedqueueprocessor
+
+import (
+	"os"
+	"slices"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/collector/client"
+	"go.opentelemetry.io/collector/pdata/pmetric"
+	"go.uber.org/zap"
+)
+
+func testBatch(t *testing.T, name string) telemetry {
+	t.Helper()
+	md := pmetric.NewMetrics()
+	md.ResourceMetrics().AppendEmpty().ScopeMetrics().AppendEmpty().Metrics().AppendEmpty().SetName(name)
+	return metricsBatch{md}
+}
+
+func batchName(item queueItem) string {
+	rms := item.data.(metricsBatch).md.ResourceMetrics()
+	if rms.Len() == 0 {
+		return ""
+	}
+	return rms.At(0).ScopeMetrics().At(0).Metrics().At(0).Name()
+}
+
+func openTestWAL(t *testing.T, dir string) (*queueWAL, []queueItem) {
+	t.Helper()
+	w, items, err := openWAL(dir, "tenant/a", zap.NewNop(), metricsSignal.unmarshal, false)
+	if err != nil {
+		t.Fatalf("openWAL: %v", err)
+	}
+	return w, items
+}
+
+func names(items []queueItem) []string {
+	var out []string
+	for _, item := range items {
+		out = append(out, batchName(item))
+	}
+	return out
+}
+
+func TestWALRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	w, items := openTestWAL(t, dir)
+	if len(items) != 0 {
+		t.Fatalf("new WAL replayed %d items", len(items))
+	}
+
+	enqueuedAt := time.Unix(0, 1_700_000_000_123_456_789)
+	var added []queueItem
+	for _, name := range []string{"a", "b", "c"} {
+		item := queueItem{
+			data:       testBatch(t, name),
+			origin:     "origin-" + name,
+			info:       client.Info{Metadata: client.NewMetadata(map[string][]string{"x-tenant": {name, "2"}})},
+			enqueuedAt: enqueuedAt,
+		}
+		w.add(&item)
+		added = append(added, item)
+	}
+	w.remove(added[1])
+	if err := w.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	w, items = openTestWAL(t, dir)
+	defer w.close()
+	if got := names(items); !slices.Equal(got, []string{"a", "c"}) {
+		t.Fatalf("replayed %v, want [a c]", got)
+	}
+	for i, want := range []queueItem{added[0], added[2]} {
+		got := items[i]
+		if got.seq != want.seq || got.origin != want.origin || !got.enqueuedAt.Equal(want.enqueuedAt) {
+			t.Errorf("item %d: got seq %d origin %q at %v, want seq %d origin %q at %v",
+				i, got.seq, got.origin, got.enqueuedAt, want.seq, want.origin, want.enqueuedAt)
+		}
+		if got, want := got.info.Metadata.Get("X-Tenant"), want.info.Metadata.Get("x-tenant"); !slices.Equal(got, want) {
+			t.Errorf("item %d: metadata %v, want %v", i, got, want)
+		}
+	}
+
+	// New records continue after the replayed seqs
+	item := queueItem{data: testBatch(t, "d"), enqueuedAt: enqueuedAt}
+	w.add(&item)
+	if item.seq <= added[2].seq {
+		t.Errorf("seq %d after replay, want > %d", item.seq, added[2].seq)
+	}
+}
+
+func TestWALTornTail(t *testing.T) {
+	dir := t.TempDir()
+	w, _ := openTestWAL(t, dir)
+	for _, name := range []string{"a", "b"} {
+		item := queueItem{data: testBatch(t, name), enqueuedAt: time.Now()}
+		w.add(&item)
+	}
+	w.close()
+
+	path := walPath(dir, "tenant/a")
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	valid := info.Size()
+
+	// A record cut off by a crash in the middle of a write
+	w, _ = openTestWAL(t, dir)
+	item := queueItem{data: testBatch(t, "c"), enqueuedAt: time.Now()}
+	w.add(&item)
+	w.close()
+	if err := os.Truncate(path, valid+20); err != nil {
+		t.Fatal(err)
+	}
+
+	w, items := openTestWAL(t, dir)
+	if got := names(items); !slices.Equal(got, []string{"a", "b"}) {
+		t.Fatalf("replayed %v, want [a b]", got)
+	}
+	if info, err := os.Stat(path); err != nil || info.Size() != valid {
+		t.Fatalf("torn record not truncated: size %d, want %d (%v)", info.Size(), valid, err)
+	}
+
+	// Appends after the truncation replay cleanly
+	item = queueItem{data: testBatch(t, "d"), enqueuedAt: time.Now()}
+	w.add(&item)
+	w.close()
+	w, items = openTestWAL(t, dir)
+	defer w.close()
+	if got := names(items); !slices.Equal(got, []string{"a", "b", "d"}) {
+		t.Fatalf("replayed %v, want [a b d]", got)
+	}
+}
+
+func TestWALCompaction(t *testing.T) {
+	dir := t.TempDir()
+	w, _ := openTestWAL(t, dir)
+	q := &dynamicQueue{cap: 1000}
+	q.restore(w, nil)
+
+	for i := 0; i < walCompactMinDead; i++ {
+		q.enqueue(queueItem{data: testBatch(t, "old"), enqueuedAt: time.Now()})
+	}
+	q.enqueue(queueItem{data: testBatch(t, "kept"), enqueuedAt: time.Now()})
+
+	// Forward all but the last batch; one of them is still in flight when
+	// the WAL is compacted and must survive it
+	var forwarded []queueItem
+	for i := 0; i < walCompactMinDead; i++ {
+		item, _ := q.dequeue()
+		forwarded = append(forwarded, item)
+	}
+	inFlight := forwarded[len(forwarded)-1]
+	// The next consumer owns forwarded data and may move it away
+	inFlight.data.(metricsBatch).md.ResourceMetrics().MoveAndAppendTo(pmetric.NewResourceMetricsSlice())
+	q.ack(forwarded[:len(forwarded)-1]...)
+	if w.dead != 0 {
+		t.Fatalf("WAL not compacted: %d dead records", w.dead)
+	}
+	q.persist()
+
+	w, items := openTestWAL(t, dir)
+	defer w.close()
+	if len(items) != 2 || items[0].seq != inFlight.seq || batchName(items[0]) != "old" || batchName(items[1]) != "kept" {
+		t.Fatalf("replayed %v (seq %d), want the in-flight batch then kept", names(items), items[0].seq)
+	}
+}
+
+func TestQueueKeepsInFlightBatchesInWAL(t *testing.T) {
+	dir := t.TempDir()
+	w, _ := openTestWAL(t, dir)
+	q := &dynamicQueue{cap: 10}
+	q.restore(w, nil)
+	for _, name := range []string{"a", "b", "c"} {
+		q.enqueue(queueItem{data: testBatch(t, name), enqueuedAt: time.Now()})
+	}
+
+	a, _ := q.dequeue()
+	b, _ := q.dequeue()
+	q.ack(a)
+	q.requeue(b)
+	q.dequeue() // b again, in flight during the crash
+	q.persist()
+
+	w, items := openTestWAL(t, dir)
+	defer w.close()
+	if got := names(items); !slices.Equal(got, []string{"b", "c"}) {
+		t.Fatalf("replayed %v, want [b c]", got)
+	}
+}
@@ -1,9 +1,25 @@
 package weightupdateextension
 
-import "go.opentelemetry.io/collector/component"
+import (
+	"errors"
+	"strings"
+
+	"go.opentelemetry.io/collector/component"
+)
 
 type Config struct {
-    Port int `mapstructure:"port"` // e.g., 4500
+	Port int `mapstructure:"port"` // e.g., 4500
+	// PathPrefix mounts this weight domain's API under a prefix such as
+	// "/edge", so several domains can share the port. Empty serves it at
+	// the root.
+	PathPrefix string `mapstructure:"path_prefix"`
 }
 
 var _ component.Config = (*Config)(nil)
+
+func (cfg *Config) Validate() error {
+	if cfg.PathPrefix != "" && (!strings.HasPrefix(cfg.PathPrefix, "/") || strings.HasSuffix(cfg.PathPrefix, "/")) {
+		return errors.New("path_prefix must start with \"/\" and must not end with \"/\"")
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+package weightupdateextension
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"go.opentelemetry.io/collector/component"
+	"go.uber.org/zap"
+)
+
+// Domain is the scheduling state of one weight domain: the tenant weights,
+// SLO thresholds, priority tiers, rate limits and tenant activity shared by
+// the processors and exporters that use the same weightupdate extension.
+// Pipelines using different extensions are scheduled independently.
+type Domain struct {
+	Weights    *SharedWeights
+	SLOs       *SharedSLOs
+	Priorities *SharedPriorities
+	RateLimits *SharedRateLimits
+	Activity   *SharedActivity
+}
+
+func NewDomain() *Domain {
+	return &Domain{
+		Weights: &SharedWeights{
+			Weights: make(map[string]float64),
+			Pinned:  make(map[string]float64),
+		},
+		SLOs: &SharedSLOs{
+			Thresholds: make(map[string]int64),
+			Seeded:     make(map[string]int64),
+		},
+		Priorities: &SharedPriorities{Tiers: make(map[string]int)},
+		RateLimits: &SharedRateLimits{Limits: make(map[string]RateLimit)},
+		Activity: &SharedActivity{
+			LastSeen: make(map[string]time.Time),
+			Pending:  make(map[string]int),
+		},
+	}
+}
+
+// DomainProvider is implemented by the weightupdate extension
+type DomainProvider interface {
+	Domain() *Domain
+}
+
+// DomainFromHost returns the weight domain of the weightupdate extension id.
+// Without an id it uses the only weightupdate extension of the collector,
+// and a private domain if there is none, so a component works standalone.
+// A private domain is shared with no other component, not even the other
+// signals of the same processor, which is logged as a warning.
+func DomainFromHost(host component.Host, id *component.ID, logger *zap.Logger) (*Domain, error) {
+	extensions := host.GetExtensions()
+	if id != nil {
+		ext, ok := extensions[*id]
+		if !ok {
+			return nil, fmt.Errorf("weight domain extension %q not found", id)
+		}
+		provider, ok := ext.(DomainProvider)
+		if !ok {
+			return nil, fmt.Errorf("extension %q is not a weightupdate extension", id)
+		}
+		return provider.Domain(), nil
+	}
+
+	var found *Domain
+	for _, ext := range extensions {
+		provider, ok := ext.(DomainProvider)
+		if !ok {
+			continue
+		}
+		if found != nil {
+			return nil, errors.New("several weightupdate extensions are configured, set weight_domain")
+		}
+		found = provider.Domain()
+	}
+	if found == nil {
+		logger.Warn("No weightupdate extension configured, using private weights, SLOs and tenant state shared with no other component")
+		return NewDomain(), nil
+	}
+	return found, nil
+}
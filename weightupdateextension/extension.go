@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"maps"
 	"math"
 	"net/http"
 
@@ -14,44 +15,54 @@ import (
 )
 
 type extensionImpl struct {
-	config *Config
-	logger *zap.Logger
-	server *http.Server
+	config  *Config
+	logger  *zap.Logger
+	domain  *Domain // state of this extension's weight domain
+	started bool
 }
 
+var _ DomainProvider = (*extensionImpl)(nil)
+
 func newExtension(_ context.Context, set extension.Settings, cfg *Config) (*extensionImpl, error) {
 	return &extensionImpl{
 		config: cfg,
 		logger: set.Logger,
+		domain: NewDomain(),
 	}, nil
 }
 
+// Domain returns the weight domain this extension's API manages
+func (e *extensionImpl) Domain() *Domain {
+	return e.domain
+}
+
 func (e *extensionImpl) Start(ctx context.Context, _ component.Host) error {
 	mux := http.NewServeMux()
-	mux.HandleFunc("/update_weights", e.handleUpdateWeights)
-	mux.HandleFunc("/weights", e.handleGetWeights)
-	mux.HandleFunc("/delete_source", e.handleDeleteSource)
-	mux.HandleFunc("/slo/update", e.handleUpdateSLO)
-	mux.HandleFunc("/slo", e.handleGetSLO)
-	mux.HandleFunc("/slo/all", e.handleGetAllSLOs)
-
-	e.server = &http.Server{
-		Addr:    fmt.Sprintf(":%d", e.config.Port),
-		Handler: mux,
+	route := func(path string, handler http.HandlerFunc) {
+		mux.HandleFunc(e.config.PathPrefix+path, handler)
 	}
-
-	go func() {
-		if err := e.server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			e.logger.Error("Server failed", zap.Error(err))
-		}
-	}()
-	e.logger.Info("Weight update server started", zap.Int("port", e.config.Port))
+	route("/update_weights", e.handleUpdateWeights)
+	route("/weights", e.handleGetWeights)
+	route("/delete_source", e.handleDeleteSource)
+	route("/slo/update", e.handleUpdateSLO)
+	route("/slo", e.handleGetSLO)
+	route("/slo/all", e.handleGetAllSLOs)
+	route("/update_priorities", e.handleUpdatePriorities)
+	route("/priorities", e.handleGetPriorities)
+	route("/update_rate_limits", e.handleUpdateRateLimits)
+	route("/rate_limits", e.handleGetRateLimits)
+
+	if err := registerAPI(e.config.Port, e.config.PathPrefix, mux, e.logger); err != nil {
+		return err
+	}
+	e.started = true
+	e.logger.Info("Weight update server started", zap.Int("port", e.config.Port), zap.String("path_prefix", e.config.PathPrefix))
 	return nil
 }
 
 func (e *extensionImpl) Shutdown(ctx context.Context) error {
-	if e.server != nil {
-		return e.server.Shutdown(ctx)
+	if e.started {
+		return unregisterAPI(ctx, e.config.Port, e.config.PathPrefix)
 	}
 	return nil
 }
@@ -63,11 +74,18 @@ func (e *extensionImpl) handleUpdateWeights(w http.ResponseWriter, r *http.Reque
 	}
 	var req struct {
 		Weights map[string]float64 `json:"weights"`
+		Pinned  []string           `json:"pinned"` // sources whose new weight survives rebalancing
 	}
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		http.Error(w, "Invalid JSON", http.StatusBadRequest)
 		return
 	}
+	for _, source := range req.Pinned {
+		if _, ok := req.Weights[source]; !ok {
+			http.Error(w, fmt.Sprintf("Pinned source %q has no weight", source), http.StatusBadRequest)
+			return
+		}
+	}
 
 	// Validate sum ≈1
 	var sum float64
@@ -80,10 +98,19 @@ func (e *extensionImpl) handleUpdateWeights(w http.ResponseWriter, r *http.Reque
 	}
 
 	// Update shared
-	GlobalWeights.Lock()
-	GlobalWeights.Weights = req.Weights
-	GlobalWeights.NumSources = len(req.Weights)
-	GlobalWeights.Unlock()
+	e.domain.Weights.Lock()
+	e.domain.Weights.Weights = req.Weights
+	e.domain.Weights.NumSources = len(req.Weights)
+	// The update decides the pinning of the sources it names; pins of
+	// sources not in the update are kept for when they join
+	for source := range req.Weights {
+		delete(e.domain.Weights.Pinned, source)
+	}
+	for _, source := range req.Pinned {
+		e.domain.Weights.Pinned[source] = req.Weights[source]
+	}
+	e.domain.Weights.Unlock()
+	e.domain.Weights.NotifyChanged()
 
 	w.WriteHeader(http.StatusOK)
 	fmt.Fprintln(w, "Weights updated")
@@ -94,15 +121,18 @@ func (e *extensionImpl) handleGetWeights(w http.ResponseWriter, r *http.Request)
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
-	GlobalWeights.RLock()
+	e.domain.Weights.RLock()
 	resp := struct {
 		Weights    map[string]float64 `json:"weights"`
 		NumSources int                `json:"num_sources"`
+		Pinned     map[string]float64 `json:"pinned"`
 	}{
-		Weights:    GlobalWeights.Weights,
-		NumSources: GlobalWeights.NumSources,
+		// Processors update the maps in place, so encode copies
+		Weights:    maps.Clone(e.domain.Weights.Weights),
+		NumSources: e.domain.Weights.NumSources,
+		Pinned:     maps.Clone(e.domain.Weights.Pinned),
 	}
-	GlobalWeights.RUnlock()
+	e.domain.Weights.RUnlock()
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(resp)
@@ -125,21 +155,22 @@ func (e *extensionImpl) handleDeleteSource(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
-	GlobalWeights.Lock()
-	if _, exists := GlobalWeights.Weights[req.Source]; !exists {
-		GlobalWeights.Unlock()
+	e.domain.Weights.Lock()
+	if _, exists := e.domain.Weights.Weights[req.Source]; !exists {
+		e.domain.Weights.Unlock()
 		http.Error(w, "Source not found", http.StatusNotFound)
 		return
 	}
-	delete(GlobalWeights.Weights, req.Source)
-	GlobalWeights.NumSources = len(GlobalWeights.Weights)
-	if GlobalWeights.NumSources > 0 {
-		equal := 1.0 / float64(GlobalWeights.NumSources)
-		for k := range GlobalWeights.Weights {
-			GlobalWeights.Weights[k] = equal
-		}
-	}
-	GlobalWeights.Unlock()
+	delete(e.domain.Weights.Weights, req.Source)
+	delete(e.domain.Weights.Pinned, req.Source)
+	e.domain.Priorities.Lock()
+	delete(e.domain.Priorities.Tiers, req.Source)
+	e.domain.Priorities.Unlock()
+	e.domain.DeleteRateLimitForTenant(req.Source)
+	e.domain.Weights.NumSources = len(e.domain.Weights.Weights)
+	e.domain.Weights.RebalanceEqually()
+	e.domain.Weights.Unlock()
+	e.domain.Weights.NotifyChanged()
 
 	w.WriteHeader(http.StatusOK)
 	fmt.Fprintln(w, "Source deleted and weights rebalanced")
@@ -173,7 +204,7 @@ func (e *extensionImpl) handleUpdateSLO(w http.ResponseWriter, r *http.Request)
 				failCount++
 				continue
 			}
-			if err := SetSLOThresholdForTenant(u.Source, u.Threshold, u.Unit); err != nil {
+			if err := e.domain.SetSLOThresholdForTenant(u.Source, u.Threshold, u.Unit); err != nil {
 				e.logger.Warn("Bulk SLO update failed for source", zap.String("source", u.Source), zap.Error(err))
 				failCount++
 				continue
@@ -199,7 +230,7 @@ func (e *extensionImpl) handleUpdateSLO(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	if err := SetSLOThresholdForTenant(single.Source, single.Threshold, single.Unit); err != nil {
+	if err := e.domain.SetSLOThresholdForTenant(single.Source, single.Threshold, single.Unit); err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
@@ -220,7 +251,7 @@ func (e *extensionImpl) handleGetSLO(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	ns := GetSLOThresholdForTenant(source)
+	ns := e.domain.GetSLOThresholdForTenant(source)
 	seconds := float64(ns) / 1_000_000_000.0
 
 	resp := struct {
@@ -243,15 +274,15 @@ func (e *extensionImpl) handleGetAllSLOs(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	GlobalSLOs.RLock()
-	defer GlobalSLOs.RUnlock()
+	e.domain.SLOs.RLock()
+	defer e.domain.SLOs.RUnlock()
 
 	resp := make(map[string]struct {
 		ThresholdSeconds float64 `json:"threshold_seconds"`
 		Unit             string  `json:"unit"`
 	})
 
-	for source, ns := range GlobalSLOs.Thresholds {
+	for source, ns := range e.domain.SLOs.Thresholds {
 		seconds := float64(ns) / 1_000_000_000.0
 		resp[source] = struct {
 			ThresholdSeconds float64 `json:"threshold_seconds"`
@@ -265,3 +296,125 @@ func (e *extensionImpl) handleGetAllSLOs(w http.ResponseWriter, r *http.Request)
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(resp)
 }
+
+func (e *extensionImpl) handleUpdatePriorities(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req struct {
+		Priorities map[string]int `json:"priorities"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if len(req.Priorities) == 0 {
+		http.Error(w, "Missing priorities", http.StatusBadRequest)
+		return
+	}
+	for source := range req.Priorities {
+		if source == "" {
+			http.Error(w, "Source cannot be empty", http.StatusBadRequest)
+			return
+		}
+	}
+
+	// Merge into shared state; tenants not listed keep their tier
+	e.domain.Priorities.Lock()
+	for source, tier := range req.Priorities {
+		e.domain.Priorities.Tiers[source] = tier
+	}
+	e.domain.Priorities.Unlock()
+
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintln(w, "Priorities updated")
+}
+
+func (e *extensionImpl) handleGetPriorities(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	e.domain.Priorities.RLock()
+	defer e.domain.Priorities.RUnlock()
+
+	resp := struct {
+		Priorities      map[string]int `json:"priorities"`
+		DefaultPriority int            `json:"default_priority"`
+	}{
+		Priorities:      e.domain.Priorities.Tiers,
+		DefaultPriority: DefaultPriority,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (e *extensionImpl) handleUpdateRateLimits(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req struct {
+		RateLimits map[string]RateLimit `json:"rate_limits"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if len(req.RateLimits) == 0 {
+		http.Error(w, "Missing rate_limits", http.StatusBadRequest)
+		return
+	}
+
+	// Validate everything before applying, so a bad entry changes nothing.
+	// A rate of 0 removes the tenant's limit.
+	normalized := make(map[string]RateLimit, len(req.RateLimits))
+	for source, limit := range req.RateLimits {
+		if source == "" {
+			http.Error(w, "Source cannot be empty", http.StatusBadRequest)
+			return
+		}
+		if limit.Rate == 0 {
+			continue
+		}
+		n, err := NormalizeRateLimit(limit)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid rate limit for source %s: %v", source, err), http.StatusBadRequest)
+			return
+		}
+		normalized[source] = n
+	}
+
+	e.domain.RateLimits.Lock()
+	for source, limit := range req.RateLimits {
+		if limit.Rate == 0 {
+			delete(e.domain.RateLimits.Limits, source)
+			continue
+		}
+		e.domain.RateLimits.Limits[source] = normalized[source]
+	}
+	e.domain.RateLimits.Unlock()
+
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintln(w, "Rate limits updated")
+}
+
+func (e *extensionImpl) handleGetRateLimits(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	e.domain.RateLimits.RLock()
+	defer e.domain.RateLimits.RUnlock()
+
+	resp := struct {
+		RateLimits map[string]RateLimit `json:"rate_limits"`
+	}{
+		RateLimits: e.domain.RateLimits.Limits,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
@@ -5,6 +5,7 @@ go 1.25.5
 require (
 	go.opentelemetry.io/collector/component v1.48.0
 	go.opentelemetry.io/collector/extension v1.48.0
+	go.opentelemetry.io/collector/pdata v1.48.0
 	go.uber.org/zap v1.27.1
 )
 
@@ -15,7 +16,6 @@ require (
 	github.com/modern-go/concurrent v0.0.0-20180306012644-bacd9c7ef1dd // indirect
 	github.com/modern-go/reflect2 v1.0.3-0.20250322232337-35a7c28c31ee // indirect
 	go.opentelemetry.io/collector/featuregate v1.48.0 // indirect
-	go.opentelemetry.io/collector/pdata v1.48.0 // indirect
 	go.opentelemetry.io/otel v1.39.0 // indirect
 	go.opentelemetry.io/otel/metric v1.39.0 // indirect
 	go.opentelemetry.io/otel/trace v1.39.0 // indirect
@@ -0,0 +1,95 @@
+package weightupdateextension
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	"go.uber.org/zap"
+)
+
+// apiServer serves the API of every weight domain listening on one port.
+// Each domain's routes live under the path prefix of its extension.
+type apiServer struct {
+	server  *http.Server
+	mu      sync.RWMutex
+	domains map[string]http.Handler // path prefix → routes of the domain
+}
+
+var (
+	apiServersMu sync.Mutex
+	apiServers   = make(map[int]*apiServer) // port → server
+)
+
+// registerAPI mounts the routes of a domain under prefix on the server of
+// port, starting the server for the first domain.
+func registerAPI(port int, prefix string, routes http.Handler, logger *zap.Logger) error {
+	apiServersMu.Lock()
+	defer apiServersMu.Unlock()
+
+	s, ok := apiServers[port]
+	if ok {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if _, taken := s.domains[prefix]; taken {
+			return fmt.Errorf("path prefix %q is already served on port %d", prefix, port)
+		}
+		s.domains[prefix] = routes
+		return nil
+	}
+
+	s = &apiServer{domains: map[string]http.Handler{prefix: routes}}
+	s.server = &http.Server{
+		Addr:    fmt.Sprintf(":%d", port),
+		Handler: s,
+	}
+	apiServers[port] = s
+	go func() {
+		if err := s.server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			logger.Error("Server failed", zap.Error(err))
+		}
+	}()
+	return nil
+}
+
+// unregisterAPI removes the routes under prefix and stops the server of port
+// once it serves no domain.
+func unregisterAPI(ctx context.Context, port int, prefix string) error {
+	apiServersMu.Lock()
+	defer apiServersMu.Unlock()
+
+	s, ok := apiServers[port]
+	if !ok {
+		return nil
+	}
+	s.mu.Lock()
+	delete(s.domains, prefix)
+	empty := len(s.domains) == 0
+	s.mu.Unlock()
+	if !empty {
+		return nil
+	}
+	delete(apiServers, port)
+	return s.server.Shutdown(ctx)
+}
+
+// ServeHTTP dispatches to the domain with the longest matching path prefix
+func (s *apiServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.RLock()
+	var routes http.Handler
+	longest := -1
+	for prefix, h := range s.domains {
+		if len(prefix) > longest && (r.URL.Path == prefix || strings.HasPrefix(r.URL.Path, prefix+"/")) {
+			routes, longest = h, len(prefix)
+		}
+	}
+	s.mu.RUnlock()
+
+	if routes == nil {
+		http.NotFound(w, r)
+		return
+	}
+	routes.ServeHTTP(w, r)
+}
@@ -3,19 +3,88 @@ package weightupdateextension
 // import "sync"
 import (
 	"errors"
+	"math"
 	"strings"
 	"sync"
+	"time"
 )
 
-var GlobalWeights = &SharedWeights{
-	Weights:    make(map[string]float64),
-	NumSources: 0,
-}
-
 type SharedWeights struct {
 	sync.RWMutex
 	Weights    map[string]float64
 	NumSources int
+	// Pinned holds the weights that rebalancing never changes. A pinned
+	// tenant gets its weight back whenever it (re)joins Weights.
+	Pinned map[string]float64
+
+	notifyMu sync.Mutex
+	changed  chan struct{}
+}
+
+// Changed returns a channel that is closed at the next NotifyChanged call
+func (s *SharedWeights) Changed() <-chan struct{} {
+	s.notifyMu.Lock()
+	defer s.notifyMu.Unlock()
+	if s.changed == nil {
+		s.changed = make(chan struct{})
+	}
+	return s.changed
+}
+
+// NotifyChanged wakes up everyone waiting on Changed. Writers call it after
+// releasing the lock on a modified Weights map.
+func (s *SharedWeights) NotifyChanged() {
+	s.notifyMu.Lock()
+	defer s.notifyMu.Unlock()
+	if s.changed != nil {
+		close(s.changed)
+		s.changed = nil
+	}
+}
+
+// RebalanceEqually gives every unpinned tenant in Weights an equal share of
+// the weight left by the pinned tenants in Weights. Callers hold the lock.
+func (s *SharedWeights) RebalanceEqually() {
+	share, unpinned := 1.0, 0
+	for tenant := range s.Weights {
+		if w, ok := s.Pinned[tenant]; ok {
+			s.Weights[tenant] = w
+			share -= w
+		} else {
+			unpinned++
+		}
+	}
+	if unpinned == 0 {
+		return
+	}
+	share = math.Max(share, 0) / float64(unpinned)
+	for tenant := range s.Weights {
+		if _, ok := s.Pinned[tenant]; !ok {
+			s.Weights[tenant] = share
+		}
+	}
+}
+
+// UnpinnedSum returns the total weight of the unpinned tenants in Weights.
+// Callers hold the lock.
+func (s *SharedWeights) UnpinnedSum() float64 {
+	var sum float64
+	for tenant, w := range s.Weights {
+		if _, ok := s.Pinned[tenant]; !ok {
+			sum += w
+		}
+	}
+	return sum
+}
+
+// ScaleUnpinned multiplies the weight of every unpinned tenant in Weights by
+// factor. Callers hold the lock.
+func (s *SharedWeights) ScaleUnpinned(factor float64) {
+	for tenant := range s.Weights {
+		if _, ok := s.Pinned[tenant]; !ok {
+			s.Weights[tenant] *= factor
+		}
+	}
 }
 
 // DefaultSLOThreshold is used when a tenant is not explicitly configured
@@ -24,19 +93,50 @@ var DefaultSLOThreshold int64 = 5_000_000_000 // 5 seconds in nanoseconds
 type SharedSLOs struct {
 	sync.RWMutex
 	Thresholds map[string]int64 // tenant → threshold in nanoseconds
+	Seeded     map[string]int64 // tenant → threshold from component config
 }
 
-var GlobalSLOs = &SharedSLOs{
-	Thresholds: make(map[string]int64),
+// SetSLOThresholdForTenant sets threshold for a specific tenant with value + unit
+func (d *Domain) SetSLOThresholdForTenant(tenant string, value int64, unit string) error {
+	if tenant == "" {
+		return errors.New("tenant is required")
+	}
+	ns, err := sloNanoseconds(value, unit)
+	if err != nil {
+		return err
+	}
+
+	d.SLOs.Lock()
+	d.SLOs.Thresholds[tenant] = ns
+	d.SLOs.Unlock()
+
+	return nil
 }
 
-// SetSLOThresholdForTenant sets threshold for a specific tenant with value + unit
-func SetSLOThresholdForTenant(tenant string, value int64, unit string) error {
+// SeedSLOThresholdForTenant sets the threshold of a tenant from component
+// config. Unlike thresholds set at runtime, it is restored by
+// ResetSLOThresholdForTenant, like pinned weights survive idle expiry.
+func (d *Domain) SeedSLOThresholdForTenant(tenant string, value int64, unit string) error {
 	if tenant == "" {
 		return errors.New("tenant is required")
 	}
+	ns, err := sloNanoseconds(value, unit)
+	if err != nil {
+		return err
+	}
+
+	d.SLOs.Lock()
+	d.SLOs.Thresholds[tenant] = ns
+	d.SLOs.Seeded[tenant] = ns
+	d.SLOs.Unlock()
+
+	return nil
+}
+
+// sloNanoseconds converts an SLO threshold of value + unit to nanoseconds
+func sloNanoseconds(value int64, unit string) (int64, error) {
 	if value <= 0 {
-		return errors.New("slo_threshold must be positive")
+		return 0, errors.New("slo_threshold must be positive")
 	}
 
 	unit = strings.ToLower(strings.TrimSpace(unit))
@@ -53,28 +153,22 @@ func SetSLOThresholdForTenant(tenant string, value int64, unit string) error {
 	case "s", "sec", "seconds":
 		multiplier = 1_000_000_000
 	default:
-		return errors.New("invalid unit: must be ns, ms, or s")
+		return 0, errors.New("invalid unit: must be ns, ms, or s")
 	}
 
-	ns := value * multiplier
-
-	GlobalSLOs.Lock()
-	GlobalSLOs.Thresholds[tenant] = ns
-	GlobalSLOs.Unlock()
-
-	return nil
+	return value * multiplier, nil
 }
 
 // GetSLOThresholdForTenant returns the threshold in nanoseconds for a tenant
 // Returns default if the tenant has no specific value
-func GetSLOThresholdForTenant(tenant string) int64 {
+func (d *Domain) GetSLOThresholdForTenant(tenant string) int64 {
 	if tenant == "" {
 		return DefaultSLOThreshold
 	}
 
-	GlobalSLOs.RLock()
-	ns, exists := GlobalSLOs.Thresholds[tenant]
-	GlobalSLOs.RUnlock()
+	d.SLOs.RLock()
+	ns, exists := d.SLOs.Thresholds[tenant]
+	d.SLOs.RUnlock()
 
 	if !exists {
 		return DefaultSLOThreshold
@@ -84,13 +178,191 @@ func GetSLOThresholdForTenant(tenant string) int64 {
 }
 
 // RegisterNewTenant adds the tenant with default SLO if it doesn't exist yet
-func RegisterNewTenant(tenant string) {
+func (d *Domain) RegisterNewTenant(tenant string) {
 	if tenant == "" {
 		return
 	}
-	GlobalSLOs.Lock()
-	if _, exists := GlobalSLOs.Thresholds[tenant]; !exists {
-		GlobalSLOs.Thresholds[tenant] = DefaultSLOThreshold
+	d.SLOs.Lock()
+	if _, exists := d.SLOs.Thresholds[tenant]; !exists {
+		d.SLOs.Thresholds[tenant] = DefaultSLOThreshold
+	}
+	d.SLOs.Unlock()
+}
+
+// DeleteSLOThresholdForTenant removes the threshold of a tenant, which then
+// falls back to the default
+func (d *Domain) DeleteSLOThresholdForTenant(tenant string) {
+	d.SLOs.Lock()
+	delete(d.SLOs.Thresholds, tenant)
+	d.SLOs.Unlock()
+}
+
+// ResetSLOThresholdForTenant drops a threshold set at runtime, restoring the
+// one seeded from config if any and the default otherwise
+func (d *Domain) ResetSLOThresholdForTenant(tenant string) {
+	d.SLOs.Lock()
+	if ns, ok := d.SLOs.Seeded[tenant]; ok {
+		d.SLOs.Thresholds[tenant] = ns
+	} else {
+		delete(d.SLOs.Thresholds, tenant)
+	}
+	d.SLOs.Unlock()
+}
+
+type SharedActivity struct {
+	sync.RWMutex
+	LastSeen map[string]time.Time // tenant → last time data of the tenant arrived
+	Pending  map[string]int       // tenant → batches queued or in flight in any component
+}
+
+// TouchTenant records that data of a tenant arrived now
+func (d *Domain) TouchTenant(tenant string) {
+	now := time.Now()
+	d.Activity.Lock()
+	d.Activity.LastSeen[tenant] = now
+	d.Activity.Unlock()
+}
+
+// AddPending adjusts by n the batches of a tenant that a component of the
+// domain holds queued or in flight. Tenants with pending batches are never
+// idle, so no pipeline removes a tenant another one still has data of.
+func (d *Domain) AddPending(tenant string, n int) {
+	d.Activity.Lock()
+	if pending := d.Activity.Pending[tenant] + n; pending > 0 {
+		d.Activity.Pending[tenant] = pending
+	} else {
+		delete(d.Activity.Pending, tenant)
+	}
+	d.Activity.Unlock()
+}
+
+// IdleTenants returns the tenants whose data last arrived more than timeout
+// ago and that have no pending batches. Tenants that never sent data are not
+// tracked and never idle.
+func (d *Domain) IdleTenants(timeout time.Duration) []string {
+	cutoff := time.Now().Add(-timeout)
+	var idle []string
+	d.Activity.RLock()
+	for tenant, seen := range d.Activity.LastSeen {
+		if seen.Before(cutoff) && d.Activity.Pending[tenant] == 0 {
+			idle = append(idle, tenant)
+		}
+	}
+	d.Activity.RUnlock()
+	return idle
+}
+
+// IsIdle reports whether a tenant is still idle as returned by IdleTenants.
+// Callers removing the tenant check it again under Weights, which new data
+// takes after touching the tenant, so data arriving meanwhile is never lost.
+func (d *Domain) IsIdle(tenant string, timeout time.Duration) bool {
+	d.Activity.RLock()
+	defer d.Activity.RUnlock()
+	seen, ok := d.Activity.LastSeen[tenant]
+	return ok && seen.Before(time.Now().Add(-timeout)) && d.Activity.Pending[tenant] == 0
+}
+
+// ForgetTenant stops tracking the activity of a removed tenant
+func (d *Domain) ForgetTenant(tenant string) {
+	d.Activity.Lock()
+	delete(d.Activity.LastSeen, tenant)
+	d.Activity.Unlock()
+}
+
+// DefaultPriority is the tier used when a tenant has no explicit priority
+var DefaultPriority = 0
+
+type SharedPriorities struct {
+	sync.RWMutex
+	Tiers map[string]int // tenant → priority tier (higher tiers are drained first)
+}
+
+// SetPriorityForTenant assigns a tenant to a priority tier
+func (d *Domain) SetPriorityForTenant(tenant string, tier int) error {
+	if tenant == "" {
+		return errors.New("tenant is required")
+	}
+	d.Priorities.Lock()
+	d.Priorities.Tiers[tenant] = tier
+	d.Priorities.Unlock()
+	return nil
+}
+
+// GetPriorityForTenant returns the priority tier of a tenant
+// Returns default if the tenant has no specific value
+func (d *Domain) GetPriorityForTenant(tenant string) int {
+	d.Priorities.RLock()
+	tier, exists := d.Priorities.Tiers[tenant]
+	d.Priorities.RUnlock()
+
+	if !exists {
+		return DefaultPriority
+	}
+	return tier
+}
+
+// Supported values for RateLimit.Unit
+const (
+	RateUnitBatches    = "batches"
+	RateUnitDataPoints = "datapoints"
+)
+
+// RateLimit is an absolute forwarding ceiling for one tenant, enforced as a
+// token bucket that refills at Rate units per second up to Burst units
+type RateLimit struct {
+	Rate  float64 `json:"rate" mapstructure:"rate"`
+	Burst float64 `json:"burst" mapstructure:"burst"`
+	Unit  string  `json:"unit" mapstructure:"unit"` // batches (default) | datapoints
+}
+
+type SharedRateLimits struct {
+	sync.RWMutex
+	Limits map[string]RateLimit // tenant → token bucket parameters
+}
+
+// NormalizeRateLimit validates a limit and fills in defaults
+// (unit = batches, burst = max(rate, 1))
+func NormalizeRateLimit(limit RateLimit) (RateLimit, error) {
+	if limit.Rate <= 0 {
+		return limit, errors.New("rate must be positive")
 	}
-	GlobalSLOs.Unlock()
+	if limit.Burst < 0 {
+		return limit, errors.New("burst cannot be negative")
+	}
+	if limit.Burst == 0 {
+		limit.Burst = math.Max(limit.Rate, 1)
+	}
+
+	limit.Unit = strings.ToLower(strings.TrimSpace(limit.Unit))
+	switch limit.Unit {
+	case "":
+		limit.Unit = RateUnitBatches
+	case RateUnitBatches, RateUnitDataPoints:
+	default:
+		return limit, errors.New("invalid unit: must be batches or datapoints")
+	}
+	return limit, nil
+}
+
+// SetRateLimitForTenant sets or replaces the rate limit of a tenant
+func (d *Domain) SetRateLimitForTenant(tenant string, limit RateLimit) error {
+	if tenant == "" {
+		return errors.New("tenant is required")
+	}
+	limit, err := NormalizeRateLimit(limit)
+	if err != nil {
+		return err
+	}
+
+	d.RateLimits.Lock()
+	d.RateLimits.Limits[tenant] = limit
+	d.RateLimits.Unlock()
+	return nil
+}
+
+// DeleteRateLimitForTenant removes the rate limit of a tenant
+func (d *Domain) DeleteRateLimitForTenant(tenant string) {
+	d.RateLimits.Lock()
+	delete(d.RateLimits.Limits, tenant)
+	d.RateLimits.Unlock()
 }
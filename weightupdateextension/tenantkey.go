@@ -0,0 +1,89 @@
+package weightupdateextension
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"go.opentelemetry.io/collector/pdata/pcommon"
+)
+
+// DefaultTenantKeySeparator joins the values of a composite tenant key
+const DefaultTenantKeySeparator = "/"
+
+// TenantKeyRule derives a tenant from resource attributes. Rules are tried in
+// order and the first one that matches names the tenant, so a list of rules
+// expresses composite keys, fallbacks and a constant catch-all:
+//
+//	tenant_keys:
+//	  - attributes: [k8s.namespace.name, service.name]   # "prod/checkout"
+//	  - attributes: [host.name]                          # older agents
+//	  - default: unknown
+type TenantKeyRule struct {
+	// Attributes are joined with Separator into the tenant. The rule matches
+	// only if every attribute is present and non-empty.
+	Attributes []string `mapstructure:"attributes"`
+	Separator  string   `mapstructure:"separator"` // default "/"
+	// Default is a constant tenant, matching any resource. Set either
+	// Attributes or Default.
+	Default string `mapstructure:"default"`
+}
+
+// ValidateTenantKeyRules checks that every rule sets exactly one of
+// attributes and default, and fills in default separators.
+func ValidateTenantKeyRules(rules []TenantKeyRule) error {
+	for i := range rules {
+		rule := &rules[i]
+		if (len(rule.Attributes) == 0) == (rule.Default == "") {
+			return fmt.Errorf("tenant_keys[%d]: set either attributes or default", i)
+		}
+		for _, attr := range rule.Attributes {
+			if attr == "" {
+				return fmt.Errorf("tenant_keys[%d]: attribute names cannot be empty", i)
+			}
+		}
+		if rule.Separator == "" {
+			rule.Separator = DefaultTenantKeySeparator
+		}
+	}
+	return nil
+}
+
+// TenantKeyRulesOrAttribute returns rules, or a single rule reading attr
+// when no rules are configured.
+func TenantKeyRulesOrAttribute(rules []TenantKeyRule, attr string) ([]TenantKeyRule, error) {
+	if len(rules) == 0 {
+		if attr == "" {
+			return nil, errors.New("either tenant_keys or source_attribute is required")
+		}
+		rules = []TenantKeyRule{{Attributes: []string{attr}}}
+	}
+	rules = append([]TenantKeyRule(nil), rules...)
+	return rules, ValidateTenantKeyRules(rules)
+}
+
+// ResolveTenant applies rules to the resource attributes attrs and returns
+// the tenant named by the first matching rule.
+func ResolveTenant(attrs pcommon.Map, rules []TenantKeyRule) (string, bool) {
+	for _, rule := range rules {
+		if len(rule.Attributes) == 0 {
+			return rule.Default, true
+		}
+		if tenant, ok := compositeKey(attrs, rule); ok {
+			return tenant, true
+		}
+	}
+	return "", false
+}
+
+func compositeKey(attrs pcommon.Map, rule TenantKeyRule) (string, bool) {
+	parts := make([]string, len(rule.Attributes))
+	for i, attr := range rule.Attributes {
+		v, ok := attrs.Get(attr)
+		if !ok || v.AsString() == "" {
+			return "", false
+		}
+		parts[i] = v.AsString()
+	}
+	return strings.Join(parts, rule.Separator), true
+}